@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Maximum rate in bytes per second at which response bodies are read,
+// across all the workers (set by -max-bandwidth, 0 for no limit)
+var maxBandwidth int64
+
+// bucket is the token bucket shared by every throttledBody. It holds
+// up to a second's worth of bytes; a read can take it below zero, in
+// which case the reader waits until the debt has been refilled.
+var bucket struct {
+	sync.Mutex
+	tokens int64
+	last   time.Time
+}
+
+// take removes n bytes from the bucket and returns how long the reader
+// must wait for the bucket to have refilled them
+func take(n int64) time.Duration {
+	bucket.Lock()
+	defer bucket.Unlock()
+
+	now := time.Now()
+	if bucket.last.IsZero() {
+		bucket.tokens = maxBandwidth
+	} else {
+		bucket.tokens += int64(now.Sub(bucket.last).Seconds() * float64(maxBandwidth))
+		if bucket.tokens > maxBandwidth {
+			bucket.tokens = maxBandwidth
+		}
+	}
+	bucket.last = now
+
+	bucket.tokens -= n
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens) * time.Second / time.Duration(maxBandwidth)
+}
+
+// throttledBody is a response body that counts the bytes read from it
+// for the summary and, if -max-bandwidth is set, limits how fast it is
+// read. Waiting stops if ctx is cancelled.
+type throttledBody struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+// throttle wraps body in a throttledBody
+func throttle(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	return &throttledBody{body, ctx}
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+
+	// Reading no more than the bucket holds keeps each wait short
+
+	if maxBandwidth > 0 && int64(len(p)) > maxBandwidth {
+		p = p[:maxBandwidth]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	stats.bodyBytes.Add(int64(n))
+
+	if maxBandwidth > 0 && n > 0 {
+		if wait := take(int64(n)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-b.ctx.Done():
+				return n, b.ctx.Err()
+			}
+		}
+	}
+	return n, err
+}
+
+// Maximum number of HTTP requests per second across all the workers
+// (set by -rate, 0 for no limit) and when the next may be sent
+var maxRate float64
+var rateNext struct {
+	sync.Mutex
+	next time.Time
+}
+
+// waitTurn waits until a request may be sent without exceeding
+// -rate, returning early with an error if ctx is cancelled
+func waitTurn(ctx context.Context) error {
+	rateNext.Lock()
+	now := time.Now()
+	if rateNext.next.Before(now) {
+		rateNext.next = now
+	}
+	wait := rateNext.next.Sub(now)
+	rateNext.next = rateNext.next.Add(time.Duration(float64(time.Second) / maxRate))
+	rateNext.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimited is an http.RoundTripper that sends each request, which
+// includes each redirect followed and retry, when waitTurn allows
+type rateLimited struct {
+	http.RoundTripper
+}
+
+// limited returns rt limited to -rate if it is set
+func limited(rt http.RoundTripper) http.RoundTripper {
+	if maxRate <= 0 {
+		return rt
+	}
+	return &rateLimited{rt}
+}
+
+func (r *rateLimited) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := waitTurn(req.Context()); err != nil {
+		return nil, err
+	}
+	return r.RoundTripper.RoundTrip(req)
+}
+
+// CloseIdleConnections passes on http.Client.CloseIdleConnections,
+// which only works for transports that have the method
+func (r *rateLimited) CloseIdleConnections() {
+	if c, ok := r.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
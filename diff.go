@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// If true each site is taken to be an echo endpoint and the request
+// headers it says it received are compared with those sent (set by
+// -header-diff)
+var headerDiff bool
+
+// sentHeaders returns the headers that are sent for req, including
+// the Host header which is not in req.Header and, when net/http's
+// transport is used, the default User-Agent that it adds. The
+// -http10 transport sends only req.Header and the Host header.
+func sentHeaders(req *http.Request) http.Header {
+	sent := req.Header.Clone()
+	sent.Set("Host", req.Host)
+	if _, ok := sent["User-Agent"]; !ok && !http10 {
+		sent.Set("User-Agent", "Go-http-client/1.1")
+	}
+	return sent
+}
+
+// echoedHeaders parses the body of an echo endpoint's response, which
+// is decoded according to its Content-Encoding. The body must be a
+// JSON object mapping header names to values (a string or a list of
+// strings), or an object with such a map in a headers member as
+// returned by httpbin and similar services.
+func echoedHeaders(body []byte, encoding string) (http.Header, error) {
+	var r io.Reader = bytes.NewReader(body)
+	var err error
+	switch strings.ToLower(encoding) {
+	case "":
+	case "gzip":
+		r, err = gzip.NewReader(r)
+	case "deflate":
+		r, err = zlib.NewReader(r)
+	default:
+		err = errors.New("unsupported Content-Encoding " + encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if body, err = ioutil.ReadAll(r); err != nil {
+		return nil, err
+	}
+
+	var echo map[string]json.RawMessage
+	if err := json.Unmarshal(body, &echo); err != nil {
+		return nil, err
+	}
+	if inner, ok := echo["headers"]; ok {
+		echo = nil
+		if err := json.Unmarshal(inner, &echo); err != nil {
+			return nil, err
+		}
+	}
+
+	h := make(http.Header)
+	for name, raw := range echo {
+		var value string
+		var values []string
+		if json.Unmarshal(raw, &value) == nil {
+			values = []string{value}
+		} else if err := json.Unmarshal(raw, &values); err != nil {
+			return nil, errors.New("bad value for " + name)
+		}
+		for _, v := range values {
+			h.Add(name, v)
+		}
+	}
+	return h, nil
+}
+
+// diffHeaders compares the headers sent with those echoed back and
+// returns the discrepancies, in order of header name and separated by
+// ;, as -Name for a header that was removed, +Name for one that was
+// added and ~Name for one whose value was changed. Multiple values are
+// compared joined with commas since that is how they may be combined
+// in transit.
+func diffHeaders(sent, echoed http.Header) string {
+	names := make(map[string]bool)
+	for name := range sent {
+		names[name] = true
+	}
+	for name := range echoed {
+		names[name] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var diffs []string
+	for _, name := range sorted {
+		a, inSent := sent[name]
+		b, inEchoed := echoed[name]
+		switch {
+		case !inEchoed:
+			diffs = append(diffs, "-"+name)
+		case !inSent:
+			diffs = append(diffs, "+"+name)
+		case strings.Join(a, ", ") != strings.Join(b, ", "):
+			diffs = append(diffs, "~"+name)
+		}
+	}
+	return strings.Join(diffs, ";")
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bogdanovich/dns_resolver"
+	"github.com/miekg/dns"
+)
+
+// Type of DNS record queried for addresses: A or AAAA. Set by
+// -dns-type; if empty A records are queried and the type is not output.
+var dnsType string
+
+// Limits the number of DNS queries in flight at once when non-nil
+// (set by -dns-concurrency)
+var dnsSlots chan struct{}
+
+// Names whose addresses are given with -resolve-map rather than
+// looked up using the resolver
+var resolveMap = hostMap{}
+
+// hostMap maps DNS names to IP addresses. It implements flag.Value
+// so that -resolve-map can be repeated, each value being of the form
+// host:ip
+type hostMap map[string][]net.IP
+
+func (m hostMap) String() string {
+	var entries []string
+	for host, ips := range m {
+		for _, ip := range ips {
+			entries = append(entries, host+":"+ip.String())
+		}
+	}
+	return strings.Join(entries, ",")
+}
+
+func (m hostMap) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected host:ip, got %s", value)
+	}
+
+	ip := net.ParseIP(parts[1])
+	if ip == nil {
+		return fmt.Errorf("bad IP address %s", parts[1])
+	}
+
+	host := canonicalName(parts[0])
+	m[host] = append(m[host], ip)
+	return nil
+}
+
+// canonicalName returns a DNS name in the form used as a key for
+// lookups: lowercase without a trailing dot
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// dnsCache holds the addresses that names resolved to so that they can
+// be saved with -dns-cache-save and used again by a later run with
+// -dns-cache-load, or so that names are not looked up again and again
+// with -dns-cache-ttl. names is nil unless one of those is set.
+var dnsCache struct {
+	sync.Mutex
+	names map[string]dnsEntry
+}
+
+// dnsEntry is a name's addresses in dnsCache. The entry expires at
+// expires unless it is zero, as it is for entries from -dns-cache-load
+// and for all entries if -dns-cache-ttl is not set.
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// Minimum time that names looked up are cached for, however short the
+// TTL of their records (set by -dns-cache-ttl)
+var dnsCacheTTL time.Duration
+
+// loadDNSCache reads a file written by saveDNSCache into dnsCache
+func loadDNSCache(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var entries map[string][]net.IP
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	dnsCache.Lock()
+	defer dnsCache.Unlock()
+	for name, ips := range entries {
+		dnsCache.names[canonicalName(name)] = dnsEntry{ips: ips}
+	}
+	return nil
+}
+
+// saveDNSCache writes dnsCache to a file as a JSON object mapping each
+// name to its addresses
+func saveDNSCache(file string) error {
+	dnsCache.Lock()
+	entries := make(map[string][]net.IP, len(dnsCache.names))
+	for name, e := range dnsCache.names {
+		entries[name] = e.ips
+	}
+	dnsCache.Unlock()
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, append(data, '\n'), 0666)
+}
+
+// lookup returns the IP addresses for name using -resolve-map if the
+// name appears there, the DNS cache if it is in use and has an entry
+// for the name that has not expired and resolver otherwise
+func lookup(resolver *dns_resolver.DnsResolver, name string) ([]net.IP, error) {
+	key := canonicalName(name)
+	if ips, ok := resolveMap[key]; ok {
+		return ips, nil
+	}
+
+	dnsCache.Lock()
+	e, ok := dnsCache.names[key]
+	dnsCache.Unlock()
+	if ok && (e.expires.IsZero() || time.Now().Before(e.expires)) {
+		return e.ips, nil
+	}
+
+	ips, ttl, err := shared(resolver, key, func() ([]net.IP, time.Duration, error) {
+		return query(resolver, name, dnsCacheTTL > 0)
+	})
+	if err == nil && len(ips) > 0 {
+		e := dnsEntry{ips: ips}
+		if dnsCacheTTL > 0 {
+			if ttl < dnsCacheTTL {
+				ttl = dnsCacheTTL
+			}
+			e.expires = time.Now().Add(ttl)
+		}
+
+		dnsCache.Lock()
+		if dnsCache.names != nil {
+			dnsCache.names[key] = e
+		}
+		dnsCache.Unlock()
+	}
+	return ips, err
+}
+
+// Lookups in progress, keyed by the resolver's servers and the name,
+// so that concurrent lookups of the same name share one query
+var inflight = struct {
+	sync.Mutex
+	calls map[string]*flight
+}{calls: make(map[string]*flight)}
+
+// flight is a lookup in progress. done is closed when it has finished
+// and the result is available.
+type flight struct {
+	done chan struct{}
+	ips  []net.IP
+	ttl  time.Duration
+	err  error
+}
+
+// shared calls do to look up name using resolver unless a lookup of
+// the same name using the same resolver is already in progress, in
+// which case it waits for it and returns its result. This stops input
+// that repeats a name, especially one that fails to resolve, from
+// sending many identical queries at once; unlike the DNS cache nothing
+// is kept once the lookup has finished.
+func shared(resolver *dns_resolver.DnsResolver, name string,
+	do func() ([]net.IP, time.Duration, error)) ([]net.IP, time.Duration, error) {
+	key := strings.Join(resolver.Servers, ",") + " " + name
+
+	inflight.Lock()
+	if f, ok := inflight.calls[key]; ok {
+		inflight.Unlock()
+		<-f.done
+		return f.ips, f.ttl, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	inflight.calls[key] = f
+	inflight.Unlock()
+
+	f.ips, f.ttl, f.err = do()
+
+	inflight.Lock()
+	delete(inflight.calls, key)
+	inflight.Unlock()
+	close(f.done)
+
+	return f.ips, f.ttl, f.err
+}
+
+// query looks up name using resolver, respecting -dns-concurrency. If
+// ttl is true the smallest TTL of the records in the answer is also
+// returned; since resolver.LookupHost does not give the TTL the query
+// is then made by exchange instead.
+func query(resolver *dns_resolver.DnsResolver, name string, ttl bool) ([]net.IP, time.Duration, error) {
+	if dnsSlots != nil {
+		dnsSlots <- struct{}{}
+		defer func() { <-dnsSlots }()
+	}
+
+	if dnsType == "AAAA" {
+		return exchange(resolver, name, dns.TypeAAAA)
+	}
+	if ttl {
+		return exchange(resolver, name, dns.TypeA)
+	}
+	ips, err := resolver.LookupHost(name)
+	return ips, 0, err
+}
+
+// exchange is the same as resolver.LookupHost, which only queries A
+// records, but queries records of type qtype (A or AAAA) and also
+// returns the smallest TTL in the answer. Like LookupHost it picks one
+// of the resolver's servers at random for each attempt and retries
+// failed exchanges.
+func exchange(resolver *dns_resolver.DnsResolver, name string, qtype uint16) ([]net.IP, time.Duration, error) {
+	in, err := ask(resolver, dns.Fqdn(name), qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for i, rr := range in.Answer {
+		switch r := rr.(type) {
+		case *dns.A:
+			ips = append(ips, r.A)
+		case *dns.AAAA:
+			ips = append(ips, r.AAAA)
+		}
+
+		// The answer includes any CNAME records that lead to the
+		// addresses, which also limit how long they can be cached
+
+		if t := rr.Header().Ttl; i == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// ask sends a query for records of type qtype for name to one of
+// resolver's servers, retrying failed exchanges, and returns the
+// answer if it was successful
+func ask(resolver *dns_resolver.DnsResolver, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = true
+
+	var in *dns.Msg
+	var err error
+	for try := 0; try <= resolver.RetryTimes; try++ {
+		server := resolver.Servers[random.Intn(len(resolver.Servers))]
+		if in, err = dns.Exchange(m, server); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, errors.New(dns.RcodeToString[in.Rcode])
+	}
+	return in, nil
+}
+
+// reverse returns the name in the PTR record for ip using resolver,
+// respecting -dns-concurrency. If there are several records the first
+// is used.
+func reverse(resolver *dns_resolver.DnsResolver, ip string) (string, error) {
+	if dnsSlots != nil {
+		dnsSlots <- struct{}{}
+		defer func() { <-dnsSlots }()
+	}
+
+	arpa, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return "", err
+	}
+	in, err := ask(resolver, arpa, dns.TypePTR)
+	if err != nil {
+		return "", err
+	}
+
+	for _, rr := range in.Answer {
+		if r, ok := rr.(*dns.PTR); ok {
+			return strings.TrimSuffix(r.Ptr, "."), nil
+		}
+	}
+	return "", errors.New("no PTR record")
+}
+
+// Resolvers that are compared by checkConsistency (set by -resolvers)
+var consistencyResolvers []string
+
+// checkConsistency looks up name using each of consistencyResolvers
+// and returns whether they all gave the same set of addresses. If they
+// did not the sets are returned as resolver=ips entries separated by ;
+// with a failed lookup giving an empty set.
+func checkConsistency(name string) (bool, string) {
+	var sets []string
+	for _, r := range consistencyResolvers {
+		ips, _, _ := query(dns_resolver.New([]string{r}), name, false)
+
+		addresses := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addresses = append(addresses, ip.String())
+		}
+		sort.Strings(addresses)
+		sets = append(sets, strings.Join(addresses, " "))
+	}
+
+	consistent := true
+	for _, set := range sets {
+		if set != sets[0] {
+			consistent = false
+		}
+	}
+	if consistent {
+		return true, ""
+	}
+
+	entries := make([]string, len(sets))
+	for i, set := range sets {
+		entries[i] = fmt.Sprintf("%s=%s", consistencyResolvers[i], set)
+	}
+	return false, strings.Join(entries, ";")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// filter is a compiled -filter expression which decides whether a site
+// is output.
+//
+// An expression compares output fields with values using = and !=
+// and combines comparisons with AND, OR, NOT and parentheses. For
+// example,
+//
+//	present=f AND resolves=t
+//	NOT (resolves=f OR present=t)
+//
+// Values are compared with the field as it would be output so tri
+// fields are compared using the -bool-format strings. A value that
+// contains spaces, parentheses or operators must be enclosed in double
+// quotes; "" is the empty value. Keywords are not case sensitive.
+type filter interface {
+	match(s *site) bool
+}
+
+type compareFilter struct {
+	column int    // Index in columns of the field being compared
+	value  string // Value the field is compared with
+	equal  bool   // true for = and false for !=
+}
+
+func (f *compareFilter) match(s *site) bool {
+	return (columns[f.column].value(s) == f.value) == f.equal
+}
+
+type andFilter struct {
+	a, b filter
+}
+
+func (f *andFilter) match(s *site) bool {
+	return f.a.match(s) && f.b.match(s)
+}
+
+type orFilter struct {
+	a, b filter
+}
+
+func (f *orFilter) match(s *site) bool {
+	return f.a.match(s) || f.b.match(s)
+}
+
+type notFilter struct {
+	f filter
+}
+
+func (f *notFilter) match(s *site) bool {
+	return !f.f.match(s)
+}
+
+// token is a single lexical element of a filter expression. Words are
+// field names, values and keywords; quoted is set for a word that was
+// enclosed in double quotes so that it is never taken as a keyword.
+type token struct {
+	text   string
+	quoted bool
+}
+
+// tokenize splits a filter expression into tokens
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '=':
+			tokens = append(tokens, token{text: string(c)})
+			i++
+		case c == '!':
+			if i+1 >= len(expr) || expr[i+1] != '=' {
+				return nil, fmt.Errorf("expected = after ! at offset %d", i)
+			}
+			tokens = append(tokens, token{text: "!="})
+			i += 2
+		case c == '"':
+			end := strings.IndexByte(expr[i+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quote at offset %d", i)
+			}
+			tokens = append(tokens, token{text: expr[i+1 : i+1+end],
+				quoted: true})
+			i += end + 2
+		default:
+			start := i
+			for i < len(expr) && !strings.ContainsRune(" \t()=!\"", rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, token{text: expr[start:i]})
+		}
+	}
+	return tokens, nil
+}
+
+// filterParser is a recursive descent parser for filter expressions
+type filterParser struct {
+	tokens []token
+	pos    int
+	fields map[string]int // Maps field names to their index in columns
+}
+
+// parseFilter compiles expr against the current columns
+func parseFilter(expr string) (filter, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens, fields: make(map[string]int)}
+	for i, c := range columns {
+		p.fields[c.name] = i
+	}
+
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	return f, nil
+}
+
+// peek returns the next token without consuming it
+func (p *filterParser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// keyword consumes the next token and returns true if it is the
+// keyword k
+func (p *filterParser) keyword(k string) bool {
+	t, ok := p.peek()
+	if ok && !t.quoted && strings.EqualFold(t.text, k) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) or() (filter, error) {
+	f, err := p.and()
+	for err == nil && p.keyword("OR") {
+		var b filter
+		if b, err = p.and(); err == nil {
+			f = &orFilter{f, b}
+		}
+	}
+	return f, err
+}
+
+func (p *filterParser) and() (filter, error) {
+	f, err := p.not()
+	for err == nil && p.keyword("AND") {
+		var b filter
+		if b, err = p.not(); err == nil {
+			f = &andFilter{f, b}
+		}
+	}
+	return f, err
+}
+
+func (p *filterParser) not() (filter, error) {
+	if p.keyword("NOT") {
+		f, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &notFilter{f}, nil
+	}
+	return p.primary()
+}
+
+func (p *filterParser) primary() (filter, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+
+	if t.text == "(" && !t.quoted {
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || t.text != ")" || t.quoted {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return f, nil
+	}
+
+	column, ok := p.fields[t.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", t.text)
+	}
+
+	op, ok := p.peek()
+	if !ok || op.quoted || (op.text != "=" && op.text != "!=") {
+		return nil, fmt.Errorf("expected = or != after %s", t.text)
+	}
+	p.pos++
+
+	value, ok := p.peek()
+	if !ok || (!value.quoted && strings.ContainsAny(value.text, "()=")) {
+		return nil, fmt.Errorf("expected a value after %s%s", t.text, op.text)
+	}
+	p.pos++
+
+	return &compareFilter{column: column, value: value.text,
+		equal: op.text == "="}, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		expr   string
+		tokens []token
+	}{
+		{"", nil},
+		{"present=t", []token{{text: "present"}, {text: "="}, {text: "t"}}},
+		{"  present = t\t", []token{{text: "present"}, {text: "="}, {text: "t"}}},
+		{"status!=200", []token{{text: "status"}, {text: "!="}, {text: "200"}}},
+		{"NOT (a=b OR c=d)", []token{{text: "NOT"}, {text: "("}, {text: "a"},
+			{text: "="}, {text: "b"}, {text: "OR"}, {text: "c"}, {text: "="},
+			{text: "d"}, {text: ")"}}},
+		{`value="a b (c)"`, []token{{text: "value"}, {text: "="},
+			{text: "a b (c)", quoted: true}}},
+		{`value=""`, []token{{text: "value"}, {text: "="},
+			{text: "", quoted: true}}},
+		{`"AND"`, []token{{text: "AND", quoted: true}}},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.expr)
+		if err != nil {
+			t.Errorf("tokenize(%q) failed: %s", test.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("tokenize(%q) = %v, want %v", test.expr, tokens, test.tokens)
+		}
+	}
+}
+
+func TestTokenizeErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"present!t", "expected = after ! at offset 7"},
+		{"present!", "expected = after ! at offset 7"},
+		{`value="abc`, "unterminated quote at offset 6"},
+	}
+
+	for _, test := range tests {
+		_, err := tokenize(test.expr)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("tokenize(%q) error = %v, want %s", test.expr, err, test.err)
+		}
+	}
+}
+
+// filterSites returns the sites that filters are matched against, by
+// name
+func filterSites() map[string]*site {
+	return map[string]*site{
+		"nginx": {host: "a.example.com", origin: "a.example.com",
+			resolves:  tri{ran: true, yesno: true},
+			present:   tri{ran: true, yesno: true},
+			responded: true, status: 200, value: "nginx"},
+		"absent": {host: "b.example.com", origin: "b.example.com",
+			resolves:  tri{ran: true, yesno: true},
+			present:   tri{ran: true, yesno: false},
+			responded: true, status: 404},
+		"unresolved": {host: "c.example.com", origin: "c.example.com",
+			resolves: tri{ran: true, yesno: false}},
+	}
+}
+
+func TestMatch(t *testing.T) {
+	withColumns(t, "csv")
+	sites := filterSites()
+
+	tests := []struct {
+		expr  string
+		match string // Names of the sites that match, in order
+	}{
+		{"present=t", "nginx"},
+		{"present!=t", "absent unresolved"},
+		{"present=-", "unresolved"},
+		{"resolves=t AND present=f", "absent"},
+		{"resolves=f OR status=200", "nginx unresolved"},
+		{"NOT resolves=f", "absent nginx"},
+		{"NOT NOT resolves=f", "unresolved"},
+		{"NOT (resolves=f OR present=t)", "absent"},
+		{"resolves=t and present=t or status=404", "absent nginx"},
+		{"resolves=t AND (present=t OR status=404)", "absent nginx"},
+		{"status=- OR present=t AND status=404", "unresolved"},
+		{`value=""`, "absent"},
+		{`value="nginx"`, "nginx"},
+		{`host="b.example.com"`, "absent"},
+	}
+
+	for _, test := range tests {
+		f, err := parseFilter(test.expr)
+		if err != nil {
+			t.Errorf("parseFilter(%q) failed: %s", test.expr, err)
+			continue
+		}
+
+		var matched []string
+		for _, name := range []string{"absent", "nginx", "unresolved"} {
+			if f.match(sites[name]) {
+				matched = append(matched, name)
+			}
+		}
+		if got := strings.Join(matched, " "); got != test.match {
+			t.Errorf("%q matched %q, want %q", test.expr, got, test.match)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	withColumns(t, "csv")
+
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"", "unexpected end of expression"},
+		{"present", "expected = or != after present"},
+		{"present=", "expected a value after present="},
+		{"present==t", "expected a value after present="},
+		{"present=(", "expected a value after present="},
+		{"nosuch=t", `unknown field "nosuch"`},
+		{`"present"`, `expected = or != after present`},
+		{"(present=t", "missing )"},
+		{"(present=t AND", "unexpected end of expression"},
+		{"present=t)", `unexpected ")"`},
+		{"present=t status=200", `unexpected "status"`},
+		{"present=t AND", "unexpected end of expression"},
+		{"NOT", "unexpected end of expression"},
+		{"present!t", "expected = after ! at offset 7"},
+	}
+
+	for _, test := range tests {
+		_, err := parseFilter(test.expr)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("parseFilter(%q) error = %v, want %s", test.expr, err, test.err)
+		}
+	}
+}
@@ -4,7 +4,8 @@
 // It expects to receive one or more lines on stdin that consist of
 // comma separated entries representing an HTTP Host header value and
 // the name of an origin web server to which to send an HTTP
-// request. For example,
+// request. Lines are parsed as CSV so a field that contains a comma
+// can be enclosed in double quotes. For example,
 //
 //  echo "www.cloudflare.com,cloudflare.com" | ./headscan -header=Cookie
 //
@@ -28,14 +29,32 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/bogdanovich/dns_resolver"
 )
@@ -43,8 +62,305 @@ import (
 // The HTTP header to look for
 var header *string
 
+// The other headers given when -header is a comma separated list. The
+// first header is the one that the present, value and other fields are
+// about; whether each of these is present is output in a field named
+// after it.
+var moreHeaders []string
+
 var resolverName string
 
+// Resolver tried when a name fails to resolve using resolverName; empty
+// for none
+var fallbackResolver string
+
+// Value of the Accept header sent with each request; empty means no
+// Accept header
+var accept string
+
+// If true the port is removed from the Host header when it is the
+// default for the scheme (see hostHeader)
+var stripDefaultPort bool
+
+// If true requests are sent as HTTP/1.0 rather than HTTP/1.1
+var http10 bool
+
+// Format of input lines: pairs (host,origin), urls (one URL per
+// line) or ips (one IP address per line, the Host header coming from
+// its PTR record)
+var inputFormat string
+
+// Maximum number of bytes of each response body that are read
+var maxBody int64
+
+// If true the SHA-256 hash of the response body is output
+var bodyHash bool
+
+// If true the addresses connected to for each site are output
+var attemptedIP bool
+
+// If true the Content-Encoding of each site's response is output
+var contentEncoding bool
+
+// If true the Vary header of each site's response is output along with
+// whether it makes the response effectively uncacheable (set by -vary)
+var showVary bool
+
+// Request headers which, if listed in Vary, make a response
+// effectively uncacheable by a shared cache since they take so many
+// values that it would very rarely be used. * is included because it
+// means the response varies on things other than headers.
+var cacheUnsafeVary = map[string]bool{
+	"*":               true,
+	"Authorization":   true,
+	"Cookie":          true,
+	"Referer":         true,
+	"User-Agent":      true,
+	"X-Forwarded-For": true,
+}
+
+// If true the header's value and the response's status code are
+// output
+var showValue bool
+var showStatus bool
+
+// If true the likely reason that the header was absent is output (set
+// by -classify-header-absence)
+var classifyAbsence bool
+
+// If true whether the certificate of an HTTPS site covers its Host
+// header is output
+var checkSAN bool
+
+// If true whether the TLS handshake with an HTTPS site succeeded and
+// whether its certificate is valid for the Host header are output (set
+// by -tls-info)
+var tlsInfo bool
+
+// Name sent using SNI when connecting to a site's origin over HTTPS:
+// host (the Host header's name) or origin (set by -sni)
+var sniFrom string
+
+// Port that pairs input origins are contacted on instead of the
+// scheme's default (set by -port)
+var portOverride string
+
+// If true the length of the header's value is output
+var valueLength bool
+
+// Number of times a failed HTTP request is retried and how long to
+// wait between attempts (see backoff)
+var retries int
+var retryBackoff string
+var retryBase time.Duration
+
+// If true pooled connections are closed after a failed request so that
+// a retry, or the next site sharing the connections, uses a fresh one
+var noReuseOnError bool
+
+// Headers that must all be present (set by -require). If any site is
+// missing one of them headscan exits with status 1.
+var required []string
+
+// Paths (and queries) requested from each site in pairs input, each
+// giving a line of output. {host} and {origin} are replaced by the
+// site's Host header and origin (set by -path or -paths; empty means
+// /)
+var pathTemplates = []string{""}
+
+// If true the path requested is output for pairs input (set by -paths)
+var showPath bool
+
+// URL schemes that each site in pairs input is tested with, each giving
+// a line of output (set by -scheme). The empty scheme means http
+// without outputting the scheme.
+var schemes = []string{""}
+
+// Format results are written in: csv or parquet
+var outputFormat string
+
+// Size of the buffer used for output and how often it is flushed
+var outputBuffer int
+var flushInterval time.Duration
+
+// If true results are grouped by the value of the header rather than
+// written out individually (see writeGroups)
+var groupByValue bool
+
+// If set only sites that match it are output (set by -filter)
+var rowFilter filter
+
+// If true lines that are the same as one already output are not output
+// again (set by -dedup-output)
+var dedupOutput bool
+
+// If non-zero the input is scanned repeatedly, waiting this long
+// between passes, and a site is only output when its result differs
+// from the previous pass (set by -watch)
+var watchInterval time.Duration
+
+// HTTP methods sent to each site after the GET to see which it allows
+// (set by -probe-methods)
+var probeMethods []string
+
+// Set when a site lacks one of the required headers
+var missingRequired bool
+
+// Counts the sites of the current -watch pass that writer has yet to
+// receive
+var watchPass sync.WaitGroup
+
+// If non-zero the run is aborted after this many consecutive
+// resolution failures since the resolver is probably down
+var abortAfter int64
+
+// Count of consecutive resolution failures across all workers and a
+// channel that is closed (once) when abortAfter is reached or headscan
+// is interrupted, which stops the input being read and sites being
+// queued
+var resolveFailures atomic.Int64
+var aborted = make(chan struct{})
+var abortOnce sync.Once
+
+// Whether aborted was closed because headscan received SIGINT or
+// SIGTERM rather than because of resolution failures
+var interrupted atomic.Bool
+
+// If true sites with the same origin are tested one after another by
+// the same worker sharing a connection
+var vhostBatch bool
+
+// If non-zero a site still being tested after this long has its
+// request cancelled by the worker's watchdog
+var maxDuration time.Duration
+
+// Maximum random time added to maxDuration and requestTimeout for each
+// site so that sites that hang do not all time out together (set by
+// -request-timeout-jitter)
+var timeoutJitter time.Duration
+
+// Time waited between resolving a site's name and requesting it (set
+// by -resolve-delay)
+var resolveDelay time.Duration
+
+// Sites slower than this to respond are reported as slow when it is
+// non-zero
+var slowThreshold time.Duration
+
+// If true a field is output showing where the header was found
+var foundIn bool
+
+// If true a field is output showing whether the request failed because
+// of too many redirects
+var redirectLoops bool
+
+// If true redirects are not followed and the redirect returned by the
+// site is classified by redirectKind
+var httpsRedirect bool
+
+// Maximum number of redirects followed for a single site (the same as
+// the net/http default)
+const maxRedirects = 10
+
+// errTooManyRedirects is returned by checkRedirect when a site has
+// redirected more than maxRedirects times
+var errTooManyRedirects = fmt.Errorf("stopped after %d redirects", maxRedirects)
+
+// User-Agent headers that one is picked from at random for each
+// request (set by -user-agent-file); if empty Go's default is sent
+var userAgents []string
+
+// Proxies that requests are sent through, rotated round-robin between
+// sites (set by -proxy-file), and the number of sites given one so far
+var proxies []*url.URL
+var proxyNext atomic.Uint64
+
+// How the dialer chooses which of a name's addresses to connect to:
+// first, random or roundrobin (set by -ip-select). ipNext holds the
+// number of connections made to each name so far for roundrobin.
+var ipSelect string
+var ipNext struct {
+	sync.Mutex
+	n map[string]int
+}
+
+// If true a site whose name does not resolve is reported as skipped
+// (set by -require-resolve)
+var requireResolve bool
+
+// Number of sites for an origin that may fail before the rest of that
+// origin's sites are skipped (set by -max-errors, 0 for no limit)
+var maxErrors int
+
+// originErrors counts the sites for each origin that got no response
+var originErrors = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// circuitOpen returns whether origin has had -max-errors failures, in
+// which case its remaining sites are not tested
+func circuitOpen(origin string) bool {
+	originErrors.Lock()
+	defer originErrors.Unlock()
+	return originErrors.counts[canonicalName(origin)] >= maxErrors
+}
+
+// originFailed records a site for origin that got no response
+func originFailed(origin string) {
+	originErrors.Lock()
+	defer originErrors.Unlock()
+	originErrors.counts[canonicalName(origin)]++
+}
+
+// resetOriginErrors forgets the failures recorded by originFailed so
+// that each -watch pass gets a fresh chance
+func resetOriginErrors() {
+	originErrors.Lock()
+	defer originErrors.Unlock()
+	originErrors.counts = make(map[string]int)
+}
+
+// TLS configuration used for HTTPS requests
+var tlsConfig = &tls.Config{}
+
+// stats aggregates counters across every site tested during a run and
+// is reported by printSummary
+var stats struct {
+	requests atomic.Int64 // HTTP requests issued (including redirects)
+	opened   atomic.Int64 // Connections newly dialed
+	reused   atomic.Int64 // Connections taken from the idle pool
+
+	bodyBytes atomic.Int64 // Bytes of response bodies read
+}
+
+// contacted is the set of IP addresses that connections were made to
+// during the run, reported by printSummary
+var contacted = struct {
+	sync.Mutex
+	ips map[string]bool
+}{ips: make(map[string]bool)}
+
+// If true printSummary lists the addresses in contacted
+var listIPs bool
+
+// connect dials address, recording the address connected to in
+// contacted if it succeeds
+func connect(ctx context.Context, network, address string) (net.Conn, error) {
+	d := net.Dialer{Timeout: requestTimeout}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		contacted.Lock()
+		contacted.ips[addr.IP.String()] = true
+		contacted.Unlock()
+	}
+	return conn, nil
+}
+
 // tri captures a tri-state. The value of yesno is true only is ran is
 // true
 type tri struct {
@@ -52,14 +368,30 @@ type tri struct {
 	yesno bool
 }
 
+// triFormat is how the three states of a tri are written
+type triFormat struct {
+	yes, no, unknown string
+}
+
+// triFormats are the formats that can be chosen with -bool-format
+var triFormats = map[string]triFormat{
+	"tf":        {"t", "f", "-"},
+	"truefalse": {"true", "false", "null"},
+	"10":        {"1", "0", "-1"},
+	"yesno":     {"yes", "no", ""},
+}
+
+// The format used by tri.String
+var triStrings = triFormats["tf"]
+
 func (t tri) String() string {
 	switch {
 	case !t.ran:
-		return "-"
+		return triStrings.unknown
 	case t.yesno:
-		return "t"
+		return triStrings.yes
 	case !t.yesno:
-		return "f"
+		return triStrings.no
 	}
 
 	// Should not be reached ever
@@ -72,166 +404,2551 @@ func (t tri) String() string {
 type site struct {
 	host   string // Host header that needs to be set
 	origin string // DNS name of the web site
+	scheme string // URL scheme to use; empty means http
+	port   string // Port to connect to; empty means the scheme's default
+	path   string // Path (and query) to request; empty means /
+
+	killed atomic.Bool // Whether the watchdog cancelled the test
+
+	// Whether reading the response body failed, so that only the
+	// results that come from the response headers are known
+	partial bool
+
+	// Transport used to make requests. test creates one if it is nil;
+	// with -vhost-batch all the sites for an origin share the first
+	// one created.
+	transport http.RoundTripper
 
 	resolves tri // Whether the name resolves
+	dnsSame  tri // Whether all -resolvers returned the same addresses
 	present  tri // Whether the header was present
+	loop     tri // Whether the request hit too many redirects
+	san      tri // Whether the origin's certificate is valid for the Host
+	ptr      tri // Whether the Host header came from a PTR record (ips input)
+
+	// Whether each of the -require headers was present (in the same
+	// order as required)
+	required []tri
+
+	// Whether each of moreHeaders was present and its value
+	more       []tri
+	moreValues []string
+
+	err       error         // Why the HTTP request failed
+	retried   int           // Number of retries of the lookup and request
+	latency   time.Duration // Time taken to receive the response headers
+	responded bool          // Whether a response was received
+	value     string        // Value of the header (multiple values joined by ; )
+	status    int           // Status code of the final response
+	proto     string        // Protocol version of the response (e.g. HTTP/1.0)
+	dnsIPs    string        // Addresses from each of -resolvers if they differ
+	resolver  string        // Resolver that resolved the origin's name
+	queried   string        // DNS record type queried for the origin's name
+	redirect  string        // Kind of redirect returned (see redirectKind)
+	hash      string        // Hex SHA-256 of the (size limited) response body
+	encoding  string        // Content-Encoding of the response
+	vary      []string      // Header names listed in the Vary header
+	diff      string        // Differences in the echoed request headers
+	diffed    bool          // Whether the echoed headers could be compared
+
+	// Where the header was found: redirect (a response that redirected
+	// to the final one), header and/or trailer
+	locations []string
+
+	// IP addresses the dialer tried to connect to, whether or not the
+	// connection succeeded, and those of any pooled connections that
+	// were reused. Protected by attemptedMu because the transport may
+	// still be dialing after the request that started the dial fails.
+	attemptedMu sync.Mutex
+	attempted   []string
+
+	// Status code returned for each of probeMethods (0 if the request
+	// failed) and the Allow header returned for OPTIONS
+	probes []int
+	allow  string
+
+	proxy *url.URL // Proxy the requests were sent through, if any
+
+	// Why the site was not tested (circuit-open or unresolved); empty
+	// if it was
+	skipped string
+
+	// Whether the last TLS handshake with the origin succeeded and
+	// whether its certificate was valid for the Host header (see
+	// recordTLS). Protected by tlsMu since the handshake happens in the
+	// dialer.
+	tlsMu     sync.Mutex
+	handshake tri
+	certValid tri
+
+	// The last response headers read for the site, exactly as sent,
+	// when -no-canonicalize-response is set (see headerRecorder), and
+	// the spellings of the header's name in the final response
+	rawMu   sync.Mutex
+	raw     []byte
+	spelled string
+
+	// The site's CSV output line. It is formatted by the worker that
+	// tested the site so that formatting is done in parallel rather
+	// than by the single writer.
+	line string
+
+	// The -watch pass that the site was tested in, counting from 0
+	pass int
+}
+
+// siteKey is the context key under which test stores the site being
+// tested so that the dialer, which may be shared by several sites with
+// -vhost-batch, can record the addresses tried for the right one
+type siteKey struct{}
+
+// attempt records that a connection to ip was attempted
+func (s *site) attempt(ip string) {
+	s.attemptedMu.Lock()
+	defer s.attemptedMu.Unlock()
+	for _, a := range s.attempted {
+		if a == ip {
+			return
+		}
+	}
+	s.attempted = append(s.attempted, ip)
+}
+
+// attemptedIPs returns the addresses recorded by attempt separated by
+// spaces or - if there were none
+func (s *site) attemptedIPs() string {
+	s.attemptedMu.Lock()
+	defer s.attemptedMu.Unlock()
+	if len(s.attempted) == 0 {
+		return "-"
+	}
+	return strings.Join(s.attempted, " ")
+}
+
+// column is a single field of the output for a site
+type column struct {
+	name  string               // Name output when -fields is set
+	kind  kind                 // Type of the field's values
+	value func(s *site) string // Returns the field's value for a site
+}
+
+// kind is the type of the values in a column
+type kind int
+
+const (
+	kindString kind = iota // Arbitrary text
+	kindTri                // A tri written according to -bool-format
+	kindInt                // An integer or - if unknown
+)
+
+// String returns the name of the kind output by -schema
+func (k kind) String() string {
+	switch k {
+	case kindTri:
+		return "bool-tri"
+	case kindInt:
+		return "int"
+	}
+	return "string"
+}
+
+// columns is the list of output fields. It always starts with the
+// origin, host, resolves and present fields and has others appended
+// depending on which options are in use
+var columns []column
+
+// duplicateColumn returns the name of a column that appears more than
+// once in columns, or empty if the names are unique
+func duplicateColumn() string {
+	seen := make(map[string]bool)
+	for _, c := range columns {
+		if seen[c.name] {
+			return c.name
+		}
+		seen[c.name] = true
+	}
+	return ""
+}
+
+// buildColumns sets columns according to the options in use
+func buildColumns() {
+	columns = []column{
+		{"origin", kindString, func(s *site) string { return s.origin }},
+		{"host", kindString, func(s *site) string { return s.host }},
+		{"resolves", kindTri, func(s *site) string { return s.resolves.String() }},
+		{"present", kindTri, func(s *site) string { return s.present.String() }},
+	}
+
+	if inputFormat == "urls" {
+		columns = append(columns,
+			column{"scheme", kindString, func(s *site) string { return s.urlScheme() }},
+			column{"path", kindString, func(s *site) string { return s.urlPath() }})
+	} else {
+		if schemes[0] != "" {
+			columns = append(columns,
+				column{"scheme", kindString, func(s *site) string { return s.urlScheme() }})
+		}
+		if showPath {
+			columns = append(columns,
+				column{"path", kindString, func(s *site) string { return s.urlPath() }})
+		}
+	}
+
+	if inputFormat == "ips" {
+		columns = append(columns,
+			column{"ptr", kindTri, func(s *site) string { return s.ptr.String() }})
+	}
+
+	if http10 {
+		columns = append(columns, column{"proto", kindString, func(s *site) string {
+			if s.proto == "" {
+				return "-"
+			}
+			return s.proto
+		}})
+	}
+
+	if fallbackResolver != "" {
+		columns = append(columns, column{"resolved_by", kindString, func(s *site) string {
+			if s.resolver == "" {
+				return "-"
+			}
+			return s.resolver
+		}})
+	}
+
+	if dnsType != "" {
+		columns = append(columns, column{"dns_type", kindString, func(s *site) string {
+			if s.queried == "" {
+				return "-"
+			}
+			return s.queried
+		}})
+	}
+
+	if len(consistencyResolvers) > 0 {
+		columns = append(columns,
+			column{"dns_consistent", kindTri, func(s *site) string { return s.dnsSame.String() }},
+			column{"dns_ips", kindString, func(s *site) string { return s.dnsIPs }})
+	}
+
+	for i, h := range moreHeaders {
+		i := i
+		columns = append(columns, column{h, kindTri, func(s *site) string {
+			if s.more == nil {
+				return tri{}.String()
+			}
+			return s.more[i].String()
+		}})
+	}
+	if showValue {
+		for i, h := range moreHeaders {
+			i := i
+			columns = append(columns, column{h + "_value", kindString, func(s *site) string {
+				if s.more == nil {
+					return "-"
+				}
+				return s.moreValues[i]
+			}})
+		}
+	}
+
+	for i, h := range required {
+		i := i
+		columns = append(columns, column{h, kindTri, func(s *site) string {
+			if s.required == nil {
+				return tri{}.String()
+			}
+			return s.required[i].String()
+		}})
+	}
+	if len(required) > 0 {
+		columns = append(columns, column{"all_present", kindTri,
+			func(s *site) string { return s.allPresent().String() }})
+	}
+
+	if retries > 0 || requestTimeout > 0 {
+		columns = append(columns,
+			column{"retries", kindInt, func(s *site) string {
+				if !s.resolves.ran {
+					return "-"
+				}
+				return strconv.Itoa(s.retried)
+			}},
+			column{"error_class", kindString, func(s *site) string { return s.errorClass() }})
+	}
+
+	if redirectLoops {
+		columns = append(columns, column{"redirect_loop", kindTri,
+			func(s *site) string { return s.loop.String() }})
+	}
+
+	if httpsRedirect {
+		columns = append(columns, column{"redirect", kindString, func(s *site) string {
+			if s.redirect == "" {
+				return "-"
+			}
+			return s.redirect
+		}})
+	}
+
+	if slowThreshold > 0 {
+		columns = append(columns, column{"slow", kindTri, func(s *site) string {
+			return tri{ran: s.responded,
+				yesno: s.latency > slowThreshold}.String()
+		}})
+	}
+
+	if maxDuration > 0 {
+		columns = append(columns, column{"watchdog", kindTri, func(s *site) string {
+			return tri{ran: true, yesno: s.killed.Load()}.String()
+		}})
+	}
+	if maxDuration > 0 || requestTimeout > 0 {
+		columns = append(columns, column{"partial", kindTri, func(s *site) string {
+			return tri{ran: s.responded, yesno: s.partial}.String()
+		}})
+	}
+
+	if maxErrors > 0 || requireResolve {
+		columns = append(columns, column{"skipped_reason", kindString,
+			func(s *site) string { return s.skipped }})
+	}
+
+	if classifyAbsence {
+		columns = append(columns, column{"absence_reason", kindString,
+			func(s *site) string { return s.absenceReason() }})
+	}
+
+	if showStatus {
+		columns = append(columns, column{"status", kindInt, func(s *site) string {
+			if !s.responded {
+				return "-"
+			}
+			return fmt.Sprintf("%d", s.status)
+		}})
+	}
+
+	if showValue {
+		columns = append(columns, column{"value", kindString, func(s *site) string {
+			if !s.responded {
+				return "-"
+			}
+			return s.value
+		}})
+	}
+
+	if valueLength {
+		columns = append(columns, column{"value_length", kindInt, func(s *site) string {
+			if !s.responded {
+				return "-"
+			}
+			return fmt.Sprintf("%d", len(s.value))
+		}})
+	}
+
+	if foundIn {
+		columns = append(columns, column{"found_in", kindString, func(s *site) string {
+			if !s.responded {
+				return "-"
+			}
+			return strings.Join(s.locations, ";")
+		}})
+	}
+
+	if rawHeaders {
+		columns = append(columns, column{"header_name", kindString, func(s *site) string {
+			if !s.responded {
+				return "-"
+			}
+			return s.spelled
+		}})
+	}
+
+	if checkSAN {
+		columns = append(columns, column{"san_covers_host", kindTri,
+			func(s *site) string { return s.san.String() }})
+	}
+
+	if tlsInfo {
+		columns = append(columns,
+			column{"tls_handshake", kindTri, func(s *site) string {
+				s.tlsMu.Lock()
+				defer s.tlsMu.Unlock()
+				return s.handshake.String()
+			}},
+			column{"cert_valid", kindTri, func(s *site) string {
+				s.tlsMu.Lock()
+				defer s.tlsMu.Unlock()
+				return s.certValid.String()
+			}})
+	}
+
+	if contentEncoding {
+		columns = append(columns, column{"content_encoding", kindString, func(s *site) string {
+			if !s.responded {
+				return "-"
+			}
+			return s.encoding
+		}})
+	}
+
+	if showVary {
+		columns = append(columns,
+			column{"vary", kindString, func(s *site) string {
+				if !s.responded {
+					return "-"
+				}
+				return strings.Join(s.vary, ";")
+			}},
+			column{"vary_unsafe", kindTri, func(s *site) string {
+				unsafe := false
+				for _, name := range s.vary {
+					unsafe = unsafe || cacheUnsafeVary[name]
+				}
+				return tri{ran: s.responded, yesno: unsafe}.String()
+			}})
+	}
+
+	if attemptedIP {
+		columns = append(columns, column{"attempted_ip", kindString,
+			func(s *site) string { return s.attemptedIPs() }})
+	}
+
+	if bodyHash {
+		columns = append(columns, column{"body_hash", kindString, func(s *site) string {
+			if s.hash == "" {
+				return "-"
+			}
+			return s.hash
+		}})
+	}
+
+	if headerDiff {
+		columns = append(columns, column{"header_diff", kindString, func(s *site) string {
+			if !s.diffed {
+				return "-"
+			}
+			return s.diff
+		}})
+	}
+
+	if len(proxies) > 0 {
+		columns = append(columns, column{"proxy", kindString, func(s *site) string {
+			if s.proxy == nil {
+				return "-"
+			}
+			return s.proxy.Redacted()
+		}})
+	}
+
+	for i, m := range probeMethods {
+		i := i
+		columns = append(columns, column{strings.ToLower(m) + "_status", kindInt,
+			func(s *site) string {
+				if s.probes == nil || s.probes[i] == 0 {
+					return "-"
+				}
+				return fmt.Sprintf("%d", s.probes[i])
+			}})
+		if m == "OPTIONS" {
+			columns = append(columns, column{"allow", kindString, func(s *site) string {
+				if s.probes == nil || s.probes[i] == 0 {
+					return "-"
+				}
+				return s.allow
+			}})
+		}
+	}
 }
 
-// test tests a site and looks for the header
-func (s *site) test(l *os.File) {
+// test tests a site and looks for the header. The HTTP request is
+// abandoned if ctx is cancelled.
+func (s *site) test(ctx context.Context, l *os.File) {
 	resolver := dns_resolver.New([]string{resolverName})
 
+	if inputFormat == "ips" && s.host == "" {
+		s.derive(resolver, l)
+	}
+
+	name := s.origin
+	if len(consistencyResolvers) > 0 && net.ParseIP(name) == nil {
+		s.dnsSame.ran = true
+		s.dnsSame.yesno, s.dnsIPs = checkConsistency(name)
+	}
+
 	// Check that the origin server resolves
 
 	s.resolves.ran = true
-	name := s.origin
 	if net.ParseIP(name) == nil {
-		_, err := resolver.LookupHost(name)
+		s.resolver = resolverName
+		if _, ok := resolveMap[canonicalName(name)]; ok {
+			s.resolver = "resolve-map"
+		} else {
+			s.queried = dnsType
+		}
+
+		_, err := lookup(resolver, name)
+		for attempt := 1; err != nil && attempt <= retries &&
+			retryable(&resolveError{name, err}) && ctx.Err() == nil; attempt++ {
+			wait := backoff(attempt)
+			s.logf(l, "Error resolving name, retrying in %s: %s", wait, err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+			s.retried++
+			_, err = lookup(resolver, name)
+		}
+		if err != nil && fallbackResolver != "" {
+			s.logf(l, "Error resolving name, trying %s: %s", fallbackResolver,
+				err)
+
+			// The fallback resolver is also used to connect to the
+			// origin since it is the one that can resolve its name
+
+			resolver = dns_resolver.New([]string{fallbackResolver})
+			s.resolver = fallbackResolver
+			_, err = lookup(resolver, name)
+		}
 		if err != nil {
 			s.logf(l, "Error resolving name: %s", err)
+			s.resolver = ""
 			s.resolves.yesno = false
+			if requireResolve {
+				s.skipped = "unresolved"
+			}
+			if abortAfter > 0 && resolveFailures.Add(1) >= abortAfter {
+				abortOnce.Do(func() { close(aborted) })
+			}
 			return
 		}
+		resolveFailures.Store(0)
 	}
 	s.resolves.yesno = true
 
+	if resolveDelay > 0 {
+		select {
+		case <-time.After(resolveDelay):
+		case <-ctx.Done():
+		}
+	}
+
 	// Custom dialer is needed to use special DNS resolver so that the
 	// default resolver can be overriden
 
-	transport := &http.Transport{}
-	transport.Dial = func(network, address string) (net.Conn, error) {
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
 		host, port, err := net.SplitHostPort(address)
 		if err != nil {
 			return nil, err
 		}
 
+		dialing, _ := ctx.Value(siteKey{}).(*site)
+
 		if net.ParseIP(host) != nil {
-			return net.Dial(network, address)
+			if dialing != nil {
+				dialing.attempt(host)
+			}
+			return connect(ctx, network, address)
 		}
 
-		ips, err := resolver.LookupHost(host)
+		ips, err := lookup(resolver, host)
 		if err != nil {
-			return nil, err
+			return nil, &resolveError{host, err}
 		}
 
 		if len(ips) == 0 {
 			return nil, fmt.Errorf("Failed to get any IPs for %s", address)
 		}
 
-		return net.Dial(network, net.JoinHostPort(ips[0].String(), port))
+		ip := pickIP(host, ips).String()
+		if dialing != nil {
+			dialing.attempt(ip)
+		}
+		return connect(ctx, network, net.JoinHostPort(ip, port))
 	}
 
-	client := &http.Client{Transport: transport}
-	req, err := http.NewRequest("GET", "http://"+name, nil)
+	if s.transport == nil {
+		t := &http.Transport{
+			DialContext:     dial,
+			DialTLSContext:  dialTLS(dial),
+			TLSClientConfig: tlsConfig.Clone(),
+		}
+		if rawHeaders {
+			t = recordingTransport(dial)
+		}
+		if len(proxies) > 0 {
 
-	req.Header.Set("Accept-Encoding", "gzip,deflate")
-	req.Header.Set("Host", s.host)
+			// With -vhost-batch the worker sets the proxy chosen for
+			// the first site for the origin
 
-	s.present.ran = true
-	resp, err := client.Do(req)
-	if err != nil {
-		s.logf(l, "HTTP request %#v failed: %s", req, err)
-		return
-	}
-	s.present.yesno = resp.Header.Get(*header) != ""
-	if resp != nil && resp.Body != nil {
-		ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-	}
-}
+			if s.proxy == nil {
+				s.proxy = proxies[(proxyNext.Add(1)-1)%uint64(len(proxies))]
+			}
+			t.Proxy = http.ProxyURL(s.proxy)
 
-// logf writes to the log file prefixing with the origin being logged
-func (s *site) logf(f *os.File, format string, a ...interface{}) {
-	if f != nil {
-		fmt.Fprintf(f, fmt.Sprintf(s.origin+": "+format+"\n", a...))
-	}
-}
+			// net/http does the TLS handshake with an origin reached
+			// through a proxy itself rather than using DialTLSContext,
+			// so the name to send using SNI has to be set here
 
-// fields returns the list of fields that String() will return for a
-// site
-func (s *site) fields() string {
-	return "origin,host,resolves,present"
-}
+			if sniFrom == "host" {
+				t.TLSClientConfig.ServerName = hostname(s.host)
+			}
+		}
+		t.ResponseHeaderTimeout = requestTimeout
+		s.transport = t
+		if http10 {
+			s.transport = &http10Transport{dial: dial, dialTLS: dialTLS(dial)}
+			if rawHeaders {
+				s.transport = &http10Transport{dial: recordingDial(dial),
+					dialTLS: recordingDial(dialTLS(dial))}
+			}
+		}
+	}
 
-func (s *site) String() string {
-	return fmt.Sprintf("%s,%s,%s,%s", s.origin, s.host, s.resolves, s.present)
-}
+	// Whether the header was in a redirect response on the way to the
+	// final response
 
-var wg sync.WaitGroup
+	inRedirect := false
 
-func worker(work, result chan *site, l *os.File) {
-	for s := range work {
-		s.test(l)
-		result <- s
+	timeout := requestTimeout
+	if timeout > 0 {
+		timeout += jitter()
 	}
-	wg.Done()
-}
-
-func writer(result chan *site, stop chan struct{}, fields bool) {
-	first := true
-	for s := range result {
-		if fields && first {
-			fmt.Printf("%s\n", s.fields())
-			first = false
+	client := &http.Client{Transport: limited(s.transport),
+		Timeout: timeout}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.Response != nil && hasHeader(req.Response.Header, *header) {
+			inRedirect = true
 		}
-
-		fmt.Printf("%s\n", s)
+		return checkRedirect(req, via)
 	}
-	close(stop)
-}
-
-func main() {
-	resolver := flag.String("resolver", "127.0.0.1", "DNS resolver address")
-	header = flag.String("header", "", "HTTP header to look for")
-	workers := flag.Int("workers", 10, "Number of concurrent workers")
-	log := flag.String("log", "", "File to write log information to")
-	fields := flag.Bool("fields", false,
-		"If set outputs a header line containing field names")
-	flag.Parse()
-
-	if *header == "" {
-		fmt.Println("-header must be present")
+	if httpsRedirect {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url(), nil)
+	if err != nil {
+		s.logf(l, "Error creating request: %s", err)
+		s.err = err
 		return
 	}
 
-	*header = http.CanonicalHeaderKey(*header)
+	// Note that net/http ignores a Host set in req.Header; req.Host
+	// is what is sent
 
-	if *workers < 1 {
-		fmt.Println("-workers must be a positive number")
-		return
+	req.Header.Set("Accept-Encoding", "gzip,deflate")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
 	}
+	req.Host = s.hostHeader()
+	s.setUserAgent(req, l)
 
-	resolverName = *resolver
+	// Count requests and connections so that the effectiveness of
+	// connection pooling can be reported at the end of the run
 
-	var l *os.File
-	var err error
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			stats.requests.Add(1)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				stats.reused.Add(1)
+				if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+					s.attempt(addr.IP.String())
+				}
+				if tc, ok := info.Conn.(*tls.Conn); ok && tlsInfo {
+					state := tc.ConnectionState()
+					s.recordTLS(&state, nil)
+				}
+			} else {
+				stats.opened.Add(1)
+			}
+		},
+	}
+	traced := httptrace.WithClientTrace(req.Context(), trace)
+	req = req.WithContext(context.WithValue(traced, siteKey{}, s))
+
+	s.present.ran = true
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		inRedirect = false
+		start := time.Now()
+		resp, err = client.Do(req)
+		s.latency = time.Since(start)
+		if err == nil || attempt > retries || !retryable(err) || ctx.Err() != nil {
+			break
+		}
+		s.retried++
+
+		if noReuseOnError {
+			client.CloseIdleConnections()
+		}
+
+		wait := backoff(attempt)
+		s.logf(l, "HTTP request failed, retrying in %s: %s", wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+	}
+	s.loop.ran = true
+	s.loop.yesno = errors.Is(err, errTooManyRedirects)
+	if err != nil {
+		s.logf(l, "HTTP request %#v failed: %s", req, err)
+		s.err = err
+
+		// The transport may be shared with the next site (with
+		// -vhost-batch) so it should not be given a bad connection
+		// either
+
+		if noReuseOnError {
+			client.CloseIdleConnections()
+		}
+		return
+	}
+	s.responded = true
+	s.status = resp.StatusCode
+	s.proto = resp.Proto
+	s.encoding = resp.Header.Get("Content-Encoding")
+	s.vary = varyNames(resp.Header)
+	if rawHeaders {
+		s.spelled = s.rawNames(*header)
+	}
+
+	// The certificate is only for the Host if the response came from
+	// the origin rather than somewhere it redirected to. The
+	// certificate has already been verified for the origin's name.
+
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 &&
+		resp.Request.URL.Host == req.URL.Host {
+		cert := resp.TLS.PeerCertificates[0]
+		s.san.ran = true
+		s.san.yesno = cert.VerifyHostname(hostname(s.host)) == nil
+	}
+	if httpsRedirect {
+		s.redirect = s.redirectKind(resp)
+	}
+	if len(required) > 0 {
+		s.required = make([]tri, len(required))
+		for i, h := range required {
+			s.required[i] = tri{ran: true, yesno: hasHeader(resp.Header, h)}
+		}
+	}
+
+	// The results that only need the headers are recorded before the
+	// body is read so that they are kept if reading the body fails,
+	// e.g. because a slow origin is cancelled by the watchdog
+
+	if inRedirect {
+		s.locations = append(s.locations, "redirect")
+	}
+
+	values := resp.Header.Values(*header)
+	if hasHeader(resp.Header, *header) {
+		s.locations = append(s.locations, "header")
+	}
+	s.value = strings.Join(values, "; ")
+	s.present.yesno = hasHeader(resp.Header, *header)
+
+	s.more = make([]tri, len(moreHeaders))
+	s.moreValues = make([]string, len(moreHeaders))
+	for i, h := range moreHeaders {
+		v := resp.Header.Values(h)
+		s.more[i] = tri{ran: true, yesno: hasHeader(resp.Header, h)}
+		s.moreValues[i] = strings.Join(v, "; ")
+	}
+
+	if resp.Body != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(throttle(ctx, resp.Body),
+			maxBody))
+		resp.Body.Close()
+		if err != nil {
+			s.logf(l, "Error reading body, keeping results from the headers: %s",
+				err)
+			s.partial = true
+		}
+		if bodyHash && !s.partial {
+			sum := sha256.Sum256(body)
+			s.hash = hex.EncodeToString(sum[:])
+		}
+		if headerDiff && !s.partial {
+			echoed, err := echoedHeaders(body, s.encoding)
+			if err != nil {
+				s.logf(l, "Error parsing echoed headers: %s", err)
+			} else {
+				s.diffed = true
+				s.diff = diffHeaders(sentHeaders(resp.Request), echoed)
+			}
+		}
+	}
+
+	// The header may be sent as a trailer instead, which is only
+	// available once the body has been read
+
+	if hasHeader(resp.Trailer, *header) && !s.partial {
+		s.locations = append(s.locations, "trailer")
+		values = append(values, resp.Trailer.Values(*header)...)
+		s.value = strings.Join(values, "; ")
+		s.present.yesno = true
+	}
+	for i, h := range moreHeaders {
+		if hasHeader(resp.Trailer, h) && !s.partial {
+			v := append(resp.Header.Values(h), resp.Trailer.Values(h)...)
+			s.more[i].yesno = true
+			s.moreValues[i] = strings.Join(v, "; ")
+		}
+	}
+	for i, h := range required {
+		if hasHeader(resp.Trailer, h) && !s.partial {
+			s.required[i].yesno = true
+		}
+	}
+
+	if len(probeMethods) > 0 {
+		s.probe(req.Context(), l)
+	}
+}
+
+// probe sends a request to the site using each of probeMethods,
+// recording the status codes returned. Redirects are not followed so
+// that the status is for the method itself.
+func (s *site) probe(ctx context.Context, l *os.File) {
+	client := &http.Client{
+		Transport: limited(s.transport),
+		Timeout:   requestTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	s.probes = make([]int, len(probeMethods))
+	for i, method := range probeMethods {
+		req, err := http.NewRequestWithContext(ctx, method, s.url(), nil)
+		if err != nil {
+			s.logf(l, "Error creating %s request: %s", method, err)
+			continue
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		req.Host = s.hostHeader()
+		s.setUserAgent(req, l)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			s.logf(l, "HTTP %s request failed: %s", method, err)
+			continue
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(throttle(ctx, resp.Body), maxBody))
+		resp.Body.Close()
+
+		s.probes[i] = resp.StatusCode
+		if method == "OPTIONS" {
+			s.allow = strings.Join(resp.Header.Values("Allow"), ", ")
+		}
+	}
+}
+
+// setUserAgent sets the User-Agent of req to one picked at random from
+// userAgents, logging the one chosen
+func (s *site) setUserAgent(req *http.Request, l *os.File) {
+	if len(userAgents) == 0 {
+		return
+	}
+
+	ua := userAgents[random.Intn(len(userAgents))]
+	s.logf(l, "%s request using User-Agent %q", req.Method, ua)
+	req.Header.Set("User-Agent", ua)
+}
+
+// absenceReason classifies why the header was absent from the site's
+// response using its status code: no-response if the request failed,
+// redirect for a redirect that was not followed, client-error and
+// server-error for 4xx and 5xx responses and not-sent for any other
+// response, whose server simply did not send the header. It returns
+// the empty string if the header was present and - if the site was not
+// tested.
+func (s *site) absenceReason() string {
+	switch {
+	case !s.present.ran:
+		return "-"
+	case s.present.yesno:
+		return ""
+	case !s.responded:
+		return "no-response"
+	case s.status >= 300 && s.status <= 399:
+		return "redirect"
+	case s.status >= 400 && s.status <= 499:
+		return "client-error"
+	case s.status >= 500 && s.status <= 599:
+		return "server-error"
+	}
+	return "not-sent"
+}
+
+// varyNames returns the header names listed in the Vary headers of h,
+// canonicalized so that they can be compared with cacheUnsafeVary
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// fresh returns an untested copy of s for another -watch pass. A Host
+// header derived from a PTR record is kept rather than looked up again.
+// sniName returns the name sent using SNI when connecting to the
+// site's origin, or empty if it is not an HTTPS site or the name is the
+// origin's, which is the same for all the sites for an origin
+func (s *site) sniName() string {
+	if s.urlScheme() != "https" || sniFrom != "host" {
+		return ""
+	}
+	return hostname(s.host)
+}
+
+func (s *site) fresh() *site {
+	return &site{host: s.host, origin: s.origin, scheme: s.scheme,
+		port: s.port, path: s.path, ptr: s.ptr}
+}
+
+// derive sets the Host header of a site read from -input-format=ips
+// input to the name in the PTR record for its origin, which is an IP
+// address. If there is no PTR record the address itself is used. The
+// path, which could not be expanded until the Host header was known,
+// is then expanded.
+func (s *site) derive(resolver *dns_resolver.DnsResolver, l *os.File) {
+	s.ptr.ran = true
+	name, err := reverse(resolver, s.origin)
+	if err != nil {
+		s.logf(l, "Error looking up PTR record: %s", err)
+		s.host = s.origin
+		if strings.Contains(s.host, ":") {
+			s.host = "[" + s.host + "]"
+		}
+	} else {
+		s.host = name
+		s.ptr.yesno = true
+		s.logf(l, "Using Host %s from PTR record", name)
+	}
+	s.path = expandPath(s.path, s.host, s.origin)
+}
+
+// allPresent returns whether all the -require headers were present
+func (s *site) allPresent() tri {
+	if s.required == nil {
+		return tri{}
+	}
+
+	for _, t := range s.required {
+		if !t.yesno {
+			return tri{ran: true, yesno: false}
+		}
+	}
+	return tri{ran: true, yesno: true}
+}
+
+// redirectKind classifies the response to a request that was not
+// allowed to follow redirects. It returns none if the response is not
+// a redirect, same-host-https if it redirects to the same host over
+// HTTPS on the default port and other for any other redirect.
+func (s *site) redirectKind(resp *http.Response) string {
+	if resp.StatusCode < 300 || resp.StatusCode > 399 {
+		return "none"
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return "none"
+	}
+
+	if location.Scheme == "https" &&
+		strings.EqualFold(location.Hostname(), hostname(s.host)) &&
+		(location.Port() == "" || location.Port() == "443") {
+		return "same-host-https"
+	}
+
+	return "other"
+}
+
+// hostname returns host with any port removed
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// checkRedirect is the http.Client CheckRedirect function. It
+// returns errTooManyRedirects so that redirect loops can be told apart
+// from other failures.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errTooManyRedirects
+	}
+	return nil
+}
+
+// hostHeader returns the value to send in the Host header. This is the
+// host exactly as given unless -strip-default-port is set and the host
+// includes the default port for the scheme, in which case the port is
+// removed. RFC 7230 section 5.4 allows the port to be omitted when it
+// is the default but origins differ as to which form they accept.
+func (s *site) hostHeader() string {
+	if !stripDefaultPort {
+		return s.host
+	}
+
+	host, port, err := net.SplitHostPort(s.host)
+	if err != nil {
+		return s.host
+	}
+
+	scheme := s.urlScheme()
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+
+	return s.host
+}
+
+// urlScheme returns the URL scheme used to contact the site
+func (s *site) urlScheme() string {
+	if s.scheme == "" {
+		return "http"
+	}
+	return s.scheme
+}
+
+// urlPath returns the path (and query) requested from the site
+func (s *site) urlPath() string {
+	if s.path == "" {
+		return "/"
+	}
+	return s.path
+}
+
+// expandPath returns the path given by template for a site with the
+// given Host header and origin, escaping the substituted values
+func expandPath(template, host, origin string) string {
+	return strings.NewReplacer("{host}", url.PathEscape(host),
+		"{origin}", url.PathEscape(origin)).Replace(template)
+}
+
+// url returns the URL requested from the origin
+func (s *site) url() string {
+	host := s.origin
+	if s.port != "" {
+		host = net.JoinHostPort(host, s.port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	return s.urlScheme() + "://" + host + s.urlPath()
+}
+
+// parseURL creates a site from a URL given as input when
+// -input-format=urls. The URL's host is used as both the Host header
+// and the origin.
+func parseURL(raw string) (*site, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+
+	return &site{host: u.Host, origin: u.Hostname(), scheme: u.Scheme,
+		port: u.Port(), path: u.RequestURI()}, nil
+}
+
+// backoff returns how long to wait before retry number attempt
+// (starting at 1) according to -retry-backoff. The exponential
+// strategy includes random jitter so that workers retrying at the same
+// time spread out.
+func backoff(attempt int) time.Duration {
+	switch retryBackoff {
+	case "linear":
+		return retryBase * time.Duration(attempt)
+	case "exponential":
+		d := retryBase << uint(attempt-1)
+		if d <= 0 {
+			return retryBase
+		}
+		return d/2 + time.Duration(random.Int63n(int64(d/2)+1))
+	}
+
+	return retryBase
+}
+
+// logf writes to the log file prefixing with the origin being logged
+func (s *site) logf(f *os.File, format string, a ...interface{}) {
+	if f != nil {
+		fmt.Fprintf(f, fmt.Sprintf(s.origin+": "+format+"\n", a...))
+	}
+}
+
+// fields returns the list of fields that String() will return for a
+// site
+func (s *site) fields() string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	return strings.Join(names, ",")
+}
+
+func (s *site) String() string {
+	values := make([]string, len(columns))
+	for i, c := range columns {
+		values[i] = csvField(c.value(s))
+	}
+	return strings.Join(values, ",")
+}
+
+// csvField quotes a value for output if it contains characters that
+// would otherwise break the CSV format
+func csvField(v string) string {
+	if !strings.ContainsAny(v, ",\"\r\n") {
+		return v
+	}
+	return `"` + strings.Replace(v, `"`, `""`, -1) + `"`
+}
+
+// dialFunc is the signature of the dialers used by the transports
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dialTLS returns a dialer that makes TLS connections over connections
+// made by dial. The server name sent and verified is the Host header's
+// when connecting to the origin of the site being tested, since an
+// origin that serves several names picks the certificate (and often
+// the virtual host) using SNI, and otherwise (e.g. for a redirect to
+// elsewhere) the name connected to.
+//
+// With -sni=origin the origin's name is sent instead, and the
+// certificate verified for it, to see how the origin behaves for
+// clients that do not send the Host header's name.
+func dialTLS(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		config := tlsConfig.Clone()
+		config.ServerName = hostname(address)
+		s, ok := ctx.Value(siteKey{}).(*site)
+		toOrigin := ok && strings.EqualFold(config.ServerName, s.origin)
+		if toOrigin && sniFrom == "host" {
+			config.ServerName = hostname(s.host)
+		}
+
+		tc := tls.Client(conn, config)
+		hctx := ctx
+		if requestTimeout > 0 {
+			var cancel context.CancelFunc
+			hctx, cancel = context.WithTimeout(ctx, requestTimeout)
+			defer cancel()
+		}
+		err = tc.HandshakeContext(hctx)
+		if toOrigin && tlsInfo {
+			state := tc.ConnectionState()
+			s.recordTLS(&state, err)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+}
+
+// recordTLS records the result of a TLS handshake with the site's
+// origin, or of one being reused, for -tls-info: whether it succeeded
+// and whether the certificate presented is valid for the Host header.
+// The certificate is verified here because it was verified for the
+// name sent using SNI, which may not be the Host header's, or not at
+// all with -insecure.
+func (s *site) recordTLS(state *tls.ConnectionState, err error) {
+	s.tlsMu.Lock()
+	defer s.tlsMu.Unlock()
+
+	s.handshake = tri{ran: true, yesno: err == nil}
+	s.certValid = tri{}
+
+	var verr *tls.CertificateVerificationError
+	if errors.As(err, &verr) {
+		s.certValid = tri{ran: true, yesno: false}
+		return
+	}
+	if err != nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+
+	certs := state.PeerCertificates
+	opts := x509.VerifyOptions{
+		DNSName:       hostname(s.host),
+		Roots:         tlsConfig.RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, verifyErr := certs[0].Verify(opts)
+	s.certValid = tri{ran: true, yesno: verifyErr == nil}
+}
+
+// http10Transport is an http.RoundTripper that sends requests using
+// HTTP/1.0. It is needed because the request line written by
+// net/http is always HTTP/1.1. Each request is made on a new
+// connection which is closed when the response body is closed. HTTPS
+// connections are made with dialTLS, as for HTTP/1.1.
+type http10Transport struct {
+	dial    dialFunc
+	dialTLS dialFunc
+}
+
+func (t *http10Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	dial, port := t.dial, "80"
+	switch req.URL.Scheme {
+	case "http":
+	case "https":
+		dial, port = t.dialTLS, "443"
+	default:
+		return nil, fmt.Errorf("HTTP/1.0 not supported for scheme %s",
+			req.URL.Scheme)
+	}
+
+	address := req.URL.Host
+	if req.URL.Port() == "" {
+		address = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+
+	stats.requests.Add(1)
+	conn, err := dial(req.Context(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	stats.opened.Add(1)
+
+	// Closing the connection is the only way to interrupt reading and
+	// writing it when the request is cancelled
+
+	stop := context.AfterFunc(req.Context(), func() { conn.Close() })
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%s %s HTTP/1.0\r\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(w, "Host: %s\r\n", host)
+	req.Header.Write(w)
+	w.WriteString("\r\n")
+	if err = w.Flush(); err != nil {
+		stop()
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, err
+	}
+	resp.Body = &connBody{resp.Body, conn, stop}
+	return resp, nil
+}
+
+// connBody is a response body that closes its underlying connection
+// when it is closed
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+	stop func() bool // Stops closing conn on cancellation
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.stop()
+	b.conn.Close()
+	return err
+}
+
+var wg sync.WaitGroup
+
+// watch queues groups using queue once per -watch pass until the run is
+// aborted, waiting for each pass to finish and then for watchInterval
+// before the next. The sites are replaced with fresh copies for each
+// pass after the first.
+func watch(groups [][]*site, queue func() bool) {
+	count := 0
+	for _, group := range groups {
+		count += len(group)
+	}
+
+	for n := 1; ; n++ {
+		watchPass.Add(count)
+		if !queue() {
+			return
+		}
+		watchPass.Wait()
+
+		select {
+		case <-time.After(watchInterval):
+		case <-aborted:
+			return
+		}
+
+		resetOriginErrors()
+		for _, group := range groups {
+			for i, s := range group {
+				group[i] = s.fresh()
+				group[i].pass = n
+			}
+		}
+	}
+}
+
+// worker tests each group of sites it receives. The sites in a group
+// are tested in order and share a transport, and therefore its pool of
+// connections.
+func worker(work chan []*site, result chan *site, l *os.File) {
+	for group := range work {
+
+		// The sites share a transport for each name sent using SNI,
+		// since a TLS connection made for one name must not be used
+		// for another's, and the proxy chosen for the first site
+
+		transports := make(map[string]http.RoundTripper)
+		var proxy *url.URL
+		for _, s := range group {
+			s.transport = transports[s.sniName()]
+			if maxErrors > 0 && circuitOpen(s.origin) {
+				s.logf(l, "Skipping, origin has failed %d times", maxErrors)
+				s.skipped = "circuit-open"
+			} else {
+				s.proxy = proxy
+				testWithWatchdog(s, l)
+				proxy = s.proxy
+				if maxErrors > 0 && !s.responded {
+					originFailed(s.origin)
+				}
+			}
+			transports[s.sniName()] = s.transport
+			if outputFormat == "csv" && !groupByValue {
+				s.line = s.String()
+			}
+			if outputFormat == "json" {
+				s.line = s.jsonLine()
+			}
+			result <- s
+		}
+
+		for _, transport := range transports {
+			if t, ok := transport.(interface{ CloseIdleConnections() }); ok {
+				t.CloseIdleConnections()
+			}
+		}
+	}
+	wg.Done()
+}
+
+// testWithWatchdog tests s cancelling the test if it runs for longer
+// than -max-duration-per-worker
+func testWithWatchdog(s *site, l *os.File) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The watchdog makes sure that a site that gets stuck cannot hold
+	// up the worker, and therefore the run, forever
+
+	if maxDuration > 0 {
+		timeout := maxDuration + jitter()
+		watchdog := time.AfterFunc(timeout, func() {
+			s.logf(l, "Watchdog cancelling test still running after %s",
+				timeout)
+			s.killed.Store(true)
+			cancel()
+		})
+		defer watchdog.Stop()
+	}
+
+	s.test(ctx, l)
+}
+
+// pickIP returns the address to connect to among the ips that name
+// resolved to according to -ip-select
+func pickIP(name string, ips []net.IP) net.IP {
+	switch ipSelect {
+	case "random":
+		return ips[random.Intn(len(ips))]
+	case "roundrobin":
+		ipNext.Lock()
+		defer ipNext.Unlock()
+		if ipNext.n == nil {
+			ipNext.n = make(map[string]int)
+		}
+		i := ipNext.n[name]
+		ipNext.n[name]++
+		return ips[i%len(ips)]
+	}
+	return ips[0]
+}
+
+// jitter returns a random duration between 0 and -request-timeout-jitter
+func jitter() time.Duration {
+	if timeoutJitter <= 0 {
+		return 0
+	}
+	return time.Duration(random.Int63n(int64(timeoutJitter) + 1))
+}
+
+// writer writes each result to w. Output is buffered in the
+// -output-buffer sized buffer which is flushed every -flush-interval
+// (or after every result if it is 0) and when there are no more
+// results.
+func writer(w io.Writer, result chan *site, stop chan struct{}, fields bool) {
+	var buf *bufio.Writer
+	if outputBuffer > 0 {
+		buf = bufio.NewWriterSize(w, outputBuffer)
+		w = buf
+	}
+
+	var tick <-chan time.Time
+	if buf != nil && flushInterval > 0 {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	groups := make(map[string][]string)
+
+	// The line last output for each origin and Host with -watch
+
+	previous := make(map[string]string)
+
+	// Hashes of the lines output so far with -dedup-output and the
+	// -watch pass each was last output in, since with -watch a line is
+	// only a duplicate of one output in the same pass. Only the hash is
+	// kept to limit the memory used on large runs.
+
+	seen := make(map[uint64]int)
+
+	var pw *parquetWriter
+	if outputFormat == "parquet" {
+		pw = newParquetWriter(w)
+	}
+
+	first := true
+	for {
+		select {
+		case s, ok := <-result:
+			if !ok {
+				if groupByValue {
+					writeGroups(w, groups, fields)
+				}
+				if pw != nil {
+					if err := pw.close(); err != nil {
+						fmt.Fprintf(os.Stderr, "Error writing Parquet output: %s\n", err)
+					}
+				}
+				if buf != nil {
+					buf.Flush()
+				}
+				close(stop)
+				return
+			}
+
+			if len(required) > 0 && !s.allPresent().yesno {
+				missingRequired = true
+			}
+			if watchInterval > 0 {
+				watchPass.Done()
+			}
+
+			if watchInterval > 0 {
+				key := s.host + " " + s.url()
+				if last, ok := previous[key]; ok && last == s.line {
+					continue
+				}
+				previous[key] = s.line
+			}
+
+			if rowFilter != nil && !rowFilter.match(s) {
+				continue
+			}
+
+			if dedupOutput {
+				line := s.line
+				if line == "" {
+					line = s.String()
+				}
+				h := fnv.New64a()
+				io.WriteString(h, line)
+				if pass, ok := seen[h.Sum64()]; ok && pass == s.pass {
+					continue
+				}
+				seen[h.Sum64()] = s.pass
+			}
+
+			if groupByValue {
+				value := "-"
+				if s.responded {
+					value = s.value
+				}
+				groups[value] = append(groups[value], s.origin)
+				continue
+			}
+
+			if pw != nil {
+				if err := pw.write(s); err != nil {
+					fmt.Fprintf(os.Stderr, "Error writing Parquet output: %s\n", err)
+				}
+				continue
+			}
+
+			if fields && first {
+				fmt.Fprintf(w, "%s\n", s.fields())
+				first = false
+			}
+
+			fmt.Fprintf(w, "%s\n", s.line)
+
+			if buf != nil && flushInterval == 0 {
+				buf.Flush()
+			}
+
+		case <-tick:
+			buf.Flush()
+		}
+	}
+}
+
+// writeGroups writes one line per distinct header value in groups,
+// which maps a value to the origins that returned it, giving the
+// value, the number of origins and the origins separated by spaces.
+// The largest groups are written first.
+func writeGroups(w io.Writer, groups map[string][]string, fields bool) {
+	values := make([]string, 0, len(groups))
+	for value := range groups {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		a, b := groups[values[i]], groups[values[j]]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return values[i] < values[j]
+	})
+
+	if fields {
+		fmt.Fprintf(w, "value,count,origins\n")
+	}
+
+	for _, value := range values {
+		origins := groups[value]
+		sort.Strings(origins)
+		fmt.Fprintf(w, "%s,%d,%s\n", csvField(value), len(origins),
+			csvField(strings.Join(origins, " ")))
+	}
+}
+
+// preflight tests target, given as an origin or a host,origin pair,
+// and returns an error describing why it failed if it did not
+// resolve or did not respond
+func preflight(target string, l *os.File) error {
+	s := &site{host: target, origin: target}
+	if parts := strings.Split(target, ","); len(parts) == 2 {
+		s = &site{host: parts[0], origin: parts[1]}
+	}
+
+	s.test(context.Background(), l)
+
+	if !s.resolves.yesno {
+		return fmt.Errorf("%s did not resolve using resolver %s", s.origin,
+			resolverName)
+	}
+	if !s.responded {
+		return fmt.Errorf("request to %s failed: %s", s.origin, s.err)
+	}
+	return nil
+}
+
+// readLines returns the lines of the file name with surrounding
+// white space removed, ignoring blank lines and lines starting with #
+func readLines(name string) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// readProxies reads the proxy URLs in the file name, one per line (see
+// readLines). A proxy without a scheme is assumed to be an HTTP proxy.
+func readProxies(name string) ([]*url.URL, error) {
+	lines, err := readLines(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*url.URL
+	for _, line := range lines {
+		if !strings.Contains(line, "://") {
+			line = "http://" + line
+		}
+
+		u, err := url.Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("proxy %s: scheme must be http, https or socks5", u.Redacted())
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("proxy %s has no host", u.Redacted())
+		}
+		list = append(list, u)
+	}
+	return list, nil
+}
+
+// hasHeader returns whether the header name is present in h. As
+// with the -header header, one that is sent with an empty value is
+// treated as absent.
+func hasHeader(h http.Header, name string) bool {
+	return h.Get(name) != ""
+}
+
+// validHeaderName returns whether name is a valid HTTP header field
+// name, which must be a token as defined in RFC 7230 section 3.2.6
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setFromEnv sets each flag that was not given on the command line
+// from the environment variable HEADSCAN_NAME, if it exists, where
+// NAME is the flag's name in upper case with - replaced by _
+func setFromEnv() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+
+		name := "HEADSCAN_" +
+			strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(name); ok {
+			if serr := f.Value.Set(value); serr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %s", value, name,
+					serr)
+			}
+		}
+	})
+	return err
+}
+
+// examples is printed by -examples
+const examples = `Check whether www.cloudflare.com served by cloudflare.com sets a cookie:
+
+    echo "www.cloudflare.com,cloudflare.com" | headscan -header=Cookie
+
+Survey the Server header across a list of host,origin pairs, grouping
+origins that return the same value:
+
+    headscan -header=Server -group-by-value -fields < sites.csv
+
+Check a list of URLs for security headers, failing if any are missing:
+
+    headscan -header=Strict-Transport-Security -input-format=urls \
+        -require=Strict-Transport-Security,X-Content-Type-Options < urls.txt
+
+Test an origin that is not live yet without changing DNS:
+
+    echo "www.example.com,www.example.com" | \
+        headscan -header=Cache-Control -resolve-map=www.example.com:192.0.2.1
+
+Check that plain HTTP requests redirect to HTTPS on the same host:
+
+    headscan -header=Location -https-redirect < sites.csv
+
+Archive results while watching them, with retries for flaky origins:
+
+    headscan -header=Server -retries=3 -output=-,results.csv.gz < sites.csv
+`
+
+// printSummary writes the counters gathered in stats to w
+func printSummary(w io.Writer) {
+	requests := stats.requests.Load()
+	reused := stats.reused.Load()
+
+	ratio := 0.0
+	if requests > 0 {
+		ratio = float64(reused) / float64(requests)
+	}
+
+	fmt.Fprintf(w, "requests: %d\n", requests)
+	fmt.Fprintf(w, "connections opened: %d\n", stats.opened.Load())
+	fmt.Fprintf(w, "connections reused: %d\n", reused)
+	fmt.Fprintf(w, "reuse ratio: %.3f\n", ratio)
+	fmt.Fprintf(w, "body bytes read: %d\n", stats.bodyBytes.Load())
+
+	contacted.Lock()
+	defer contacted.Unlock()
+	fmt.Fprintf(w, "distinct IPs: %d\n", len(contacted.ips))
+	if listIPs {
+		ips := make([]string, 0, len(contacted.ips))
+		for ip := range contacted.ips {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		for _, ip := range ips {
+			fmt.Fprintf(w, "  %s\n", ip)
+		}
+	}
+}
+
+// printSchema writes the names and kinds of the output fields as a JSON
+// array of objects
+func printSchema(w io.Writer) error {
+	type field struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+
+	schema := make([]field, len(columns))
+	for i, c := range columns {
+		schema[i] = field{c.name, c.kind.String()}
+	}
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+func main() {
+	resolver := flag.String("resolver", "127.0.0.1", "DNS resolver address")
+	header = flag.String("header", "",
+		"HTTP header to look for, or a comma separated list of headers")
+	workers := flag.Int("workers", 10, "Number of concurrent workers")
+	log := flag.String("log", "", "File to write log information to")
+	fields := flag.Bool("fields", false,
+		"If set outputs a header line containing field names")
+	skipHeader := flag.Bool("skip-header", false,
+		"If set ignores the first line of input (e.g. a header row from a spreadsheet)")
+	flag.BoolVar(&stripDefaultPort, "strip-default-port", false,
+		"If set removes the port from the Host header when it is the scheme's default")
+	flag.DurationVar(&resolveDelay, "resolve-delay", 0,
+		"Time to wait between resolving a site's name and requesting it")
+	flag.DurationVar(&watchInterval, "watch", 0,
+		"If set scans the input repeatedly with this long between passes, outputting only sites whose result changed")
+	flag.DurationVar(&slowThreshold, "slow-threshold", 0,
+		"If set outputs whether each site took longer than this to respond")
+	summary := flag.Bool("summary", false,
+		"If set writes a summary of the run to stderr when done")
+	flag.BoolVar(&listIPs, "summary-ips", false,
+		"If set the summary lists the distinct IP addresses connected to")
+	var outputs outputList
+	flag.Var(&outputs, "output",
+		"Where to write results: - for stdout or a file name, compressed if it ends .gz (may be repeated)")
+	var netOutputs outputList
+	flag.Var(&netOutputs, "output-net",
+		"Network listener to stream results to: tcp://host:port or unix:///path (may be repeated)")
+	flag.Int64Var(&rotateSize, "output-rotate-size", 0,
+		"Size in bytes after which output files are rotated (0 for no rotation)")
+	flag.IntVar(&outputBuffer, "output-buffer", 64*1024,
+		"Size in bytes of the output buffer (0 for unbuffered output)")
+	flag.DurationVar(&flushInterval, "flush-interval", time.Second,
+		"How often buffered output is flushed (0 to flush after every result)")
+	showSchema := flag.Bool("schema", false,
+		"If set prints the names and types of the output fields and exits")
+	showExamples := flag.Bool("examples", false,
+		"If set prints example invocations and exits")
+	flag.BoolVar(&dedupOutput, "dedup-output", false,
+		"If set lines that are the same as one already output are not output again")
+	filterExpr := flag.String("filter", "",
+		"Only output sites matching this expression, e.g. present=f AND resolves=t")
+	flag.BoolVar(&foundIn, "header-found-in", false,
+		"If set outputs where the header was found: redirect, header or trailer")
+	flag.StringVar(&outputFormat, "format", "csv",
+		"Format of the output: csv, json (one object per line) or parquet")
+	flag.BoolVar(&groupByValue, "group-by-value", false,
+		"If set outputs the origins grouped by the header's value instead of one line per site")
+	flag.BoolVar(&http10, "http10", false,
+		"If set sends requests using HTTP/1.0 and outputs the response protocol")
+	path := flag.String("path", "",
+		"Path to request, in which {host} and {origin} are replaced by the site's (default /)")
+	paths := flag.String("paths", "",
+		"Comma separated list of paths to request from each site, outputting the path")
+	inputFrom := flag.String("input-source", "stdin",
+		"Where input is read from: stdin, file or pipe (both of which are read continuously)")
+	inputPath := flag.String("input-path", "",
+		"File or named pipe to read input from with -input-source=file or pipe")
+	flag.StringVar(&inputFormat, "input-format", "pairs",
+		"Format of input lines: pairs (host,origin), urls or ips")
+	flag.BoolVar(&httpsRedirect, "https-redirect", false,
+		"If set does not follow redirects and outputs whether the site redirects to itself over HTTPS")
+	flag.BoolVar(&redirectLoops, "redirect-loops", false,
+		"If set outputs whether the request failed due to too many redirects")
+	flag.BoolVar(&valueLength, "value-length", false,
+		"If set outputs the length in bytes of the header's value")
+	flag.Int64Var(&maxBody, "max-body", 1<<20,
+		"Maximum number of bytes of each response body to read")
+	flag.BoolVar(&rawHeaders, "no-canonicalize-response", false,
+		"If set outputs the header's name exactly as the site sent it")
+	flag.BoolVar(&tlsInfo, "tls-info", false,
+		"If set outputs whether the TLS handshake succeeded and the certificate is valid for the Host header")
+	flag.StringVar(&sniFrom, "sni", "host",
+		"Name sent using SNI to HTTPS origins: host (the Host header's) or origin")
+	flag.StringVar(&portOverride, "port", "",
+		"Port to connect to origins on instead of the scheme's default (pairs input only)")
+	flag.BoolVar(&checkSAN, "check-san", false,
+		"If set outputs whether an HTTPS origin's certificate is valid for the Host header")
+	flag.BoolVar(&showValue, "value", false,
+		"If set outputs the value of each of the -header headers")
+	flag.BoolVar(&classifyAbsence, "classify-header-absence", false,
+		"If set outputs why the header was absent: no-response, redirect, client-error, server-error or not-sent")
+	flag.BoolVar(&showStatus, "status", false,
+		"If set outputs the status code of the response")
+	flag.BoolVar(&contentEncoding, "content-encoding", false,
+		"If set outputs the Content-Encoding of the response")
+	flag.BoolVar(&showVary, "vary", false,
+		"If set outputs the Vary header of the response and whether it makes the response uncacheable")
+	flag.BoolVar(&attemptedIP, "attempted-ip", false,
+		"If set outputs the IP addresses connected to, even if the connection failed")
+	flag.BoolVar(&bodyHash, "body-hash", false,
+		"If set outputs the SHA-256 hash of the response body")
+	flag.BoolVar(&headerDiff, "header-diff", false,
+		"If set treats each site as an echo endpoint and outputs how the request headers it received differ from those sent")
+	flag.StringVar(&accept, "accept", "*/*",
+		"Value of the Accept header sent with each request (empty for none)")
+	flag.Int64Var(&abortAfter, "abort-on-resolver-failure", 0,
+		"Abort the run after this many consecutive resolution failures (0 never aborts)")
+	boolFormat := flag.String("bool-format", "tf",
+		"How true, false and unknown are output: tf, truefalse, 10 or yesno")
+	flag.BoolVar(&requireResolve, "require-resolve", false,
+		"If set outputs a skipped_reason of unresolved for sites whose name does not resolve")
+	flag.IntVar(&maxErrors, "max-errors", 0,
+		"Number of sites for an origin that may fail before its remaining sites are skipped (0 for no limit)")
+	userAgentFile := flag.String("user-agent-file", "",
+		"File listing User-Agent headers, one per line, one of which is picked at random for each request")
+	proxyFile := flag.String("proxy-file", "",
+		"File listing proxy URLs, one per line, that requests are sent through in turn")
+	scheme := flag.String("scheme", "",
+		"Scheme used for pairs input: http (the default), https or both")
+	flag.BoolVar(&tlsConfig.InsecureSkipVerify, "insecure", false,
+		"If set HTTPS origins' certificates are not verified")
+	caFile := flag.String("ca-file", "",
+		"PEM file of CA certificates used to verify HTTPS origins instead of the system's")
+	clientCert := flag.String("client-cert", "",
+		"PEM file containing a client certificate for HTTPS requests")
+	clientKey := flag.String("client-key", "",
+		"PEM file containing the private key for -client-cert")
+	flag.BoolVar(&noReuseOnError, "no-reuse-on-error", false,
+		"If set closes pooled connections after a failed request so retries use a new connection")
+	preflightTarget := flag.String("preflight", "",
+		"Origin (or host,origin) that must resolve and respond before the run starts")
+	probe := flag.String("probe-methods", "",
+		"Comma separated list of HTTP methods to send to each site, outputting the status codes")
+	require := flag.String("require", "",
+		"Comma separated list of headers that must all be present")
+	flag.IntVar(&retries, "retries", 0,
+		"Number of times to retry a lookup or HTTP request that fails in a way that may be transient")
+	flag.DurationVar(&requestTimeout, "timeout", 0,
+		"If set limits dialing, the TLS handshake, waiting for the response headers and each request to this long")
+	flag.Float64Var(&maxRate, "rate", 0,
+		"Maximum HTTP requests per second across all workers (0 for no limit)")
+	flag.StringVar(&retryBackoff, "retry-backoff", "exponential",
+		"Wait between retries: constant, linear or exponential")
+	flag.DurationVar(&retryBase, "retry-base", time.Second,
+		"Base wait between retries used by -retry-backoff")
+	dnsConcurrency := flag.Int("dns-concurrency", 0,
+		"Maximum number of DNS queries in flight at once (0 for no limit)")
+	dnsCacheLoad := flag.String("dns-cache-load", "",
+		"File of DNS results saved with -dns-cache-save to use instead of querying for those names")
+	dnsCacheSave := flag.String("dns-cache-save", "",
+		"File to save the DNS results of the run to when done")
+	flag.DurationVar(&dnsCacheTTL, "dns-cache-ttl", 0,
+		"If set names are cached for at least this long, however short their TTL")
+	flag.StringVar(&ipSelect, "ip-select", "first",
+		"Which of a name's addresses to connect to: first, random or roundrobin")
+	flag.StringVar(&dnsType, "dns-type", "",
+		"Type of DNS record to query for addresses: A or AAAA")
+	flag.BoolVar(&vhostBatch, "vhost-batch", false,
+		"If set tests all the hosts for an origin in turn over a shared connection")
+	flag.Int64Var(&maxBandwidth, "max-bandwidth", 0,
+		"Maximum bytes per second of response bodies read across all workers (0 for no limit)")
+	flag.DurationVar(&maxDuration, "max-duration-per-worker", 0,
+		"If set cancels a site's test when a worker has spent this long on it")
+	flag.DurationVar(&timeoutJitter, "request-timeout-jitter", 0,
+		"Maximum random time added to -max-duration-per-worker and -timeout for each site")
+	seed := flag.Int64("seed", 0,
+		"Seed for all random choices, so that a run can be repeated (0 seeds from the time)")
+	flag.StringVar(&fallbackResolver, "fallback-resolver", "",
+		"DNS resolver address to try when a name does not resolve using -resolver")
+	resolvers := flag.String("resolvers", "",
+		"Comma separated list of DNS resolvers whose answers are compared")
+	flag.Var(resolveMap, "resolve-map",
+		"Use the given address for a name instead of the resolver (host:ip, may be repeated)")
+	flag.Parse()
+
+	if err := setFromEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	if *showExamples {
+		fmt.Print(examples)
+		return
+	}
+
+	if *header == "" {
+		fmt.Fprintln(os.Stderr, "-header must be present")
+		return
+	}
+
+	headers := strings.Split(*header, ",")
+	given := make(map[string]bool)
+	for i, h := range headers {
+		h = strings.TrimSpace(h)
+		if !validHeaderName(h) {
+			fmt.Fprintf(os.Stderr, "-header %q is not a valid HTTP header name\n", h)
+			return
+		}
+		headers[i] = http.CanonicalHeaderKey(h)
+		if given[headers[i]] {
+			fmt.Fprintf(os.Stderr, "-header %s is given more than once\n", headers[i])
+			return
+		}
+		given[headers[i]] = true
+	}
+	*header, moreHeaders = headers[0], headers[1:]
+
+	if *require != "" {
+		for _, h := range strings.Split(*require, ",") {
+			h = strings.TrimSpace(h)
+			if !validHeaderName(h) {
+				fmt.Fprintf(os.Stderr, "-require %q is not a valid HTTP header name\n", h)
+				return
+			}
+			if given[http.CanonicalHeaderKey(h)] && http.CanonicalHeaderKey(h) != *header {
+				fmt.Fprintf(os.Stderr, "-require %s is also in -header\n", http.CanonicalHeaderKey(h))
+				return
+			}
+			required = append(required, http.CanonicalHeaderKey(h))
+		}
+	}
+
+	if *probe != "" {
+		for _, m := range strings.Split(*probe, ",") {
+			m = strings.ToUpper(strings.TrimSpace(m))
+			if !validHeaderName(m) {
+				fmt.Fprintf(os.Stderr, "-probe-methods %q is not a valid HTTP method\n", m)
+				return
+			}
+			probeMethods = append(probeMethods, m)
+		}
+	}
+
+	if outputFormat != "csv" && outputFormat != "json" && outputFormat != "parquet" {
+		fmt.Fprintln(os.Stderr, "-format must be csv, json or parquet")
+		return
+	}
+
+	if outputFormat == "json" && (groupByValue || *fields) {
+		fmt.Fprintln(os.Stderr, "-group-by-value and -fields cannot be used with -format=json")
+		return
+	}
+
+	if outputFormat == "parquet" && groupByValue {
+		fmt.Fprintln(os.Stderr, "-group-by-value cannot be used with -format=parquet")
+		return
+	}
+
+	if resolveDelay < 0 {
+		fmt.Fprintln(os.Stderr, "-resolve-delay must not be negative")
+		return
+	}
+
+	if maxBandwidth < 0 {
+		fmt.Fprintln(os.Stderr, "-max-bandwidth must not be negative")
+		return
+	}
+
+	if timeoutJitter < 0 {
+		fmt.Fprintln(os.Stderr, "-request-timeout-jitter must not be negative")
+		return
+	}
+	if timeoutJitter > 0 && maxDuration == 0 && requestTimeout == 0 {
+		fmt.Fprintln(os.Stderr, "-request-timeout-jitter requires -max-duration-per-worker or -timeout")
+		return
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	random = newLockedRand(*seed)
+
+	if rotateSize < 0 {
+		fmt.Fprintln(os.Stderr, "-output-rotate-size must not be negative")
+		return
+	}
+	if rotateSize > 0 && outputFormat == "parquet" {
+		fmt.Fprintln(os.Stderr, "-output-rotate-size cannot be used with -format=parquet")
+		return
+	}
+
+	if dedupOutput && groupByValue {
+		fmt.Fprintln(os.Stderr, "-dedup-output cannot be used with -group-by-value")
+		return
+	}
+
+	if watchInterval < 0 {
+		fmt.Fprintln(os.Stderr, "-watch must not be negative")
+		return
+	}
+	if watchInterval > 0 && (groupByValue || outputFormat == "parquet") {
+		fmt.Fprintln(os.Stderr, "-watch cannot be used with -format=parquet or -group-by-value")
+		return
+	}
+
+	switch *inputFrom {
+	case "stdin":
+		if *inputPath != "" {
+			fmt.Fprintln(os.Stderr, "-input-path requires -input-source=file or pipe")
+			return
+		}
+	case "file", "pipe":
+		if *inputPath == "" {
+			fmt.Fprintf(os.Stderr, "-input-source=%s requires -input-path\n", *inputFrom)
+			return
+		}
+		if watchInterval > 0 || vhostBatch || groupByValue || outputFormat == "parquet" {
+			fmt.Fprintf(os.Stderr, "-input-source=%s cannot be used with -watch, -vhost-batch, -group-by-value or -format=parquet since the input never ends\n",
+				*inputFrom)
+			return
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "-input-source must be stdin, file or pipe")
+		return
+	}
+
+	format, ok := triFormats[*boolFormat]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "-bool-format must be tf, truefalse, 10 or yesno")
+		return
+	}
+	triStrings = format
+
+	if inputFormat != "pairs" && inputFormat != "urls" && inputFormat != "ips" {
+		fmt.Fprintln(os.Stderr, "-input-format must be pairs, urls or ips")
+		return
+	}
+
+	switch *scheme {
+	case "":
+	case "http", "https":
+		schemes = []string{*scheme}
+	case "both":
+		schemes = []string{"http", "https"}
+	default:
+		fmt.Fprintln(os.Stderr, "-scheme must be http, https or both")
+		return
+	}
+	if *scheme != "" && inputFormat == "urls" {
+		fmt.Fprintln(os.Stderr, "-scheme cannot be used with -input-format=urls")
+		return
+	}
+
+	if portOverride != "" {
+		if n, err := strconv.Atoi(portOverride); err != nil || n < 1 || n > 65535 {
+			fmt.Fprintln(os.Stderr, "-port must be a port number between 1 and 65535")
+			return
+		}
+		if inputFormat == "urls" {
+			fmt.Fprintln(os.Stderr, "-port cannot be used with -input-format=urls")
+			return
+		}
+	}
+
+	if sniFrom != "host" && sniFrom != "origin" {
+		fmt.Fprintln(os.Stderr, "-sni must be host or origin")
+		return
+	}
+
+	if *path != "" && *paths != "" {
+		fmt.Fprintln(os.Stderr, "-path and -paths cannot both be used")
+		return
+	}
+	if *path != "" {
+		pathTemplates = []string{*path}
+	}
+	if *paths != "" {
+		showPath = true
+		pathTemplates = nil
+		for _, p := range strings.Split(*paths, ",") {
+			pathTemplates = append(pathTemplates, strings.TrimSpace(p))
+		}
+	}
+	if *path != "" || *paths != "" {
+		if inputFormat == "urls" {
+			fmt.Fprintln(os.Stderr, "-path and -paths cannot be used with -input-format=urls")
+			return
+		}
+		for _, p := range pathTemplates {
+			if !strings.HasPrefix(p, "/") {
+				fmt.Fprintf(os.Stderr, "Path %q must start with /\n", p)
+				return
+			}
+			if _, err := url.Parse(expandPath(p, "host", "origin")); err != nil {
+				fmt.Fprintf(os.Stderr, "Path %q is not valid: %s\n", p, err)
+				return
+			}
+		}
+	}
+
+	if maxBody < 0 {
+		fmt.Fprintln(os.Stderr, "-max-body must not be negative")
+		return
+	}
+
+	if outputBuffer < 0 {
+		fmt.Fprintln(os.Stderr, "-output-buffer must not be negative")
+		return
+	}
+
+	if retries < 0 {
+		fmt.Fprintln(os.Stderr, "-retries must not be negative")
+		return
+	}
+
+	if requestTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "-timeout must not be negative")
+		return
+	}
+
+	if maxRate < 0 {
+		fmt.Fprintln(os.Stderr, "-rate must not be negative")
+		return
+	}
+
+	switch retryBackoff {
+	case "constant", "linear", "exponential":
+	default:
+		fmt.Fprintln(os.Stderr, "-retry-backoff must be constant, linear or exponential")
+		return
+	}
+
+	if *workers < 1 {
+		fmt.Fprintln(os.Stderr, "-workers must be a positive number")
+		return
+	}
+
+	resolverName = *resolver
+
+	if *resolvers != "" {
+		consistencyResolvers = strings.Split(*resolvers, ",")
+	}
+
+	if maxErrors < 0 {
+		fmt.Fprintln(os.Stderr, "-max-errors must not be negative")
+		return
+	}
+
+	if *dnsConcurrency < 0 {
+		fmt.Fprintln(os.Stderr, "-dns-concurrency must not be negative")
+		return
+	}
+	if *dnsConcurrency > 0 {
+		dnsSlots = make(chan struct{}, *dnsConcurrency)
+	}
+
+	if dnsCacheTTL < 0 {
+		fmt.Fprintln(os.Stderr, "-dns-cache-ttl must not be negative")
+		return
+	}
+	if *dnsCacheLoad != "" || *dnsCacheSave != "" || dnsCacheTTL > 0 {
+		dnsCache.names = make(map[string]dnsEntry)
+	}
+	if *dnsCacheLoad != "" {
+		if err := loadDNSCache(*dnsCacheLoad); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load DNS cache: %s\n", err)
+			return
+		}
+	}
+
+	if ipSelect != "first" && ipSelect != "random" && ipSelect != "roundrobin" {
+		fmt.Fprintln(os.Stderr, "-ip-select must be first, random or roundrobin")
+		return
+	}
+
+	dnsType = strings.ToUpper(dnsType)
+	if dnsType != "" && dnsType != "A" && dnsType != "AAAA" {
+		fmt.Fprintln(os.Stderr, "-dns-type must be A or AAAA")
+		return
+	}
+
+	if (*clientCert == "") != (*clientKey == "") {
+		fmt.Fprintln(os.Stderr, "-client-cert and -client-key must be used together")
+		return
+	}
+
+	if *clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load client certificate: %s\n", err)
+			return
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if *caFile != "" {
+		pem, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read CA file: %s\n", err)
+			return
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			fmt.Fprintf(os.Stderr, "No certificates found in CA file %s\n", *caFile)
+			return
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if *proxyFile != "" {
+		if http10 {
+			fmt.Fprintln(os.Stderr, "-proxy-file cannot be used with -http10")
+			return
+		}
+		if rawHeaders {
+			fmt.Fprintln(os.Stderr, "-proxy-file cannot be used with -no-canonicalize-response")
+			return
+		}
+		if tlsInfo {
+			fmt.Fprintln(os.Stderr, "-proxy-file cannot be used with -tls-info")
+			return
+		}
+
+		list, err := readProxies(*proxyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read proxy file: %s\n", err)
+			return
+		}
+		if len(list) == 0 {
+			fmt.Fprintf(os.Stderr, "No proxies found in proxy file %s\n", *proxyFile)
+			return
+		}
+		proxies = list
+	}
+
+	if *userAgentFile != "" {
+		list, err := readLines(*userAgentFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read User-Agent file: %s\n", err)
+			return
+		}
+		if len(list) == 0 {
+			fmt.Fprintf(os.Stderr, "No User-Agents found in User-Agent file %s\n", *userAgentFile)
+			return
+		}
+		userAgents = list
+	}
+
+	// JSON output is for consumers that go by name, and without the
+	// status they cannot tell a missing header from a failing site
+	if outputFormat == "json" {
+		showStatus = true
+	}
+
+	buildColumns()
+	if name := duplicateColumn(); name != "" {
+		fmt.Fprintf(os.Stderr, "The field %s would be output more than once\n", name)
+		return
+	}
+
+	if *filterExpr != "" {
+		f, err := parseFilter(*filterExpr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Bad -filter expression: %s\n", err)
+			return
+		}
+		rowFilter = f
+	}
+
+	if *showSchema {
+		if err := printSchema(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing schema: %s\n", err)
+		}
+		return
+	}
+
+	var l *os.File
+	var err error
 	if *log != "" {
 		if l, err = os.Create(*log); err != nil {
-			fmt.Printf("Failed to create log file %s: %s\n", *log, err)
+			fmt.Fprintf(os.Stderr, "Failed to create log file %s: %s\n", *log, err)
 			return
 		}
 		defer l.Close()
 	}
 
-	work := make(chan *site)
+	if *preflightTarget != "" {
+		if err := preflight(*preflightTarget, l); err != nil {
+			fmt.Fprintf(os.Stderr, "Preflight check failed: %s\n", err)
+			return
+		}
+	}
+
+	source, err := openInput(*inputFrom, *inputPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open input %s: %s\n", *inputPath, err)
+		return
+	}
+	defer source.Close()
+
+	if len(outputs) == 0 && len(netOutputs) == 0 {
+		outputs = outputList{"-"}
+	}
+
+	// The header line is repeated at the start of each rotated file
+
+	var fieldsLine string
+	if *fields {
+		fieldsLine = (&site{}).fields() + "\n"
+		if groupByValue {
+			fieldsLine = "value,count,origins\n"
+		}
+	}
+
+	var sinks []io.Writer
+	var opened []io.WriteCloser
+	names := append(append([]string{}, outputs...), netOutputs...)
+	for i, name := range names {
+		var out io.WriteCloser
+		var err error
+		if i < len(outputs) {
+			out, err = openOutput(name, fieldsLine)
+		} else {
+			out, err = openNet(name, fieldsLine, l)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open output %s: %s\n", name, err)
+			for _, o := range opened {
+				o.Close()
+			}
+			return
+		}
+		sinks = append(sinks, out)
+		opened = append(opened, out)
+	}
+
+	work := make(chan []*site)
 	result := make(chan *site)
 	stop := make(chan struct{})
 
-	go writer(result, stop, *fields)
+	go writer(io.MultiWriter(sinks...), result, stop, *fields)
 
 	for i := 0; i < *workers; i++ {
 		wg.Add(1)
 		go worker(work, result, l)
 	}
 
-	scan := bufio.NewScanner(os.Stdin)
-	for scan.Scan() {
-		parts := strings.Split(scan.Text(), ",")
-		if len(parts) != 2 {
-			fmt.Printf("Bad line: %s\n", scan.Text())
-		} else {
-			work <- &site{host: parts[0], origin: parts[1]}
+	// On SIGINT or SIGTERM stop reading the input and let the sites
+	// already queued finish so that the outputs are closed properly.
+	// A second signal kills headscan.
+
+	signalled, stopSignals := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalled.Done()
+		stopSignals()
+		abortOnce.Do(func() {
+			interrupted.Store(true)
+			close(aborted)
+		})
+		fmt.Fprintln(os.Stderr, "Interrupted, waiting for the sites being tested")
+	}()
+
+	// Input is parsed as CSV so that fields containing commas can be
+	// quoted
+
+	input := csv.NewReader(source)
+	input.FieldsPerRecord = -1
+
+	// queue queues a group of sites to be tested and returns false if
+	// the run has been aborted
+
+	queue := func(group []*site) bool {
+		select {
+		case work <- group:
+			return true
+		case <-aborted:
+			return false
+		}
+	}
+
+	// send queues a group of sites from one line of input to be
+	// tested or, with -vhost-batch or -watch, adds it to groups to be
+	// queued once all the input has been read. With -vhost-batch the
+	// groups are merged so that each holds the sites for an origin.
+
+	var groups [][]*site
+	batches := make(map[string]int)
+	send := func(group ...*site) bool {
+		if !vhostBatch && watchInterval == 0 {
+			return queue(group)
+		}
+
+		if !vhostBatch {
+			groups = append(groups, group)
+			return true
+		}
+
+		for _, s := range group {
+			origin := canonicalName(s.origin)
+			if i, ok := batches[origin]; ok {
+				groups[i] = append(groups[i], s)
+				continue
+			}
+			batches[origin] = len(groups)
+			groups = append(groups, []*site{s})
 		}
+		return true
+	}
+
+	// sendPair sends a site for each of schemes and paths for a line of
+	// pairs or ips input. They are sent as a group so that they share
+	// connections to the origin. With ips input host is empty and the
+	// path is expanded once test has found the Host header.
+
+	sendPair := func(host, origin string) bool {
+		var group []*site
+		for _, scheme := range schemes {
+			for _, p := range pathTemplates {
+				if host != "" {
+					p = expandPath(p, host, origin)
+				}
+				group = append(group, &site{host: host, origin: origin,
+					scheme: scheme, port: portOverride, path: p})
+			}
+		}
+		return send(group...)
+	}
+
+	skip := *skipHeader
+
+	var readErr error
+	for {
+		parts, err := input.Read()
+		if err == io.EOF {
+			break
+		}
+		if skip {
+			skip = false
+			if err == nil {
+				continue
+			}
+			if _, ok := err.(*csv.ParseError); ok {
+				continue
+			}
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				fmt.Fprintf(os.Stderr, "Bad line: %s\n", err)
+				continue
+			}
+			readErr = err
+			break
+		}
+
+		if inputFormat == "urls" {
+			// An unquoted URL containing commas will have been split
+			// into several fields
+
+			raw := strings.Join(parts, ",")
+			s, err := parseURL(raw)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Bad line: %s: %s\n", raw, err)
+			} else if !send(s) {
+				break
+			}
+		} else if inputFormat == "ips" {
+			ip := strings.TrimSpace(strings.Join(parts, ","))
+			if net.ParseIP(ip) == nil {
+				fmt.Fprintf(os.Stderr, "Bad line: %s: not an IP address\n", ip)
+			} else if !sendPair("", ip) {
+				break
+			}
+		} else if len(parts) != 2 {
+			fmt.Fprintf(os.Stderr, "Bad line: %s\n", strings.Join(parts, ","))
+		} else if !sendPair(parts[0], parts[1]) {
+			break
+		}
+	}
+
+	queueGroups := func() bool {
+		for _, group := range groups {
+			if !queue(group) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if watchInterval == 0 {
+		queueGroups()
+	} else if readErr == nil {
+		watch(groups, queueGroups)
 	}
 
 	close(work)
@@ -239,8 +2956,38 @@ func main() {
 	close(result)
 	<-stop
 
-	if scan.Err() != nil {
-		fmt.Printf("Error reading input: %s\n", scan.Err())
+	for i, out := range opened {
+		if err := out.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to close output %s: %s\n", names[i], err)
+		}
+	}
+
+	if *dnsCacheSave != "" {
+		if err := saveDNSCache(*dnsCacheSave); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save DNS cache: %s\n", err)
+		}
+	}
+
+	select {
+	case <-aborted:
+		if !interrupted.Load() {
+			fmt.Fprintf(os.Stderr, "Aborted after %d consecutive resolution failures; is resolver %s down?\n",
+				abortAfter, resolverName)
+			os.Exit(1)
+		}
+	default:
+	}
+
+	if readErr != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", readErr)
 		return
 	}
+
+	if *summary {
+		printSummary(os.Stderr)
+	}
+
+	if missingRequired || interrupted.Load() {
+		os.Exit(1)
+	}
 }
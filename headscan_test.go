@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// withColumns sets -header=Server, -value, -status and the output
+// format, builds the columns for them and restores the options and
+// columns when tb finishes
+func withColumns(tb testing.TB, format string) {
+	h, value, status, f, c := header, showValue, showStatus, outputFormat, columns
+	tb.Cleanup(func() {
+		header, showValue, showStatus, outputFormat, columns = h, value, status, f, c
+	})
+
+	name := "Server"
+	header = &name
+	showValue = true
+	showStatus = true
+	outputFormat = format
+	buildColumns()
+}
+
+// benchSite returns a site with a typical set of results
+func benchSite() *site {
+	return &site{
+		host:      "www.example.com",
+		origin:    "example.com",
+		scheme:    "https",
+		resolves:  tri{ran: true, yesno: true},
+		present:   tri{ran: true, yesno: true},
+		responded: true,
+		status:    200,
+		value:     "cloudflare, \"quoted\"",
+	}
+}
+
+// benchLine formats a site's output line as the worker does for format
+func benchLine(s *site, format string) string {
+	if format == "json" {
+		return s.jsonLine()
+	}
+	return s.String()
+}
+
+// BenchmarkWriter measures what the single writer goroutine spends on
+// each site now that the workers format the lines
+func BenchmarkWriter(b *testing.B) {
+	for _, format := range []string{"csv", "json"} {
+		b.Run(format, func(b *testing.B) {
+			withColumns(b, format)
+			s := benchSite()
+			s.line = benchLine(s, format)
+
+			result := make(chan *site)
+			stop := make(chan struct{})
+			go writer(ioutil.Discard, result, stop, false)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				result <- s
+			}
+			close(result)
+			<-stop
+		})
+	}
+}
+
+// BenchmarkLine measures formatting a site's line, which was done by
+// the writer for every site and is now spread across the workers
+func BenchmarkLine(b *testing.B) {
+	for _, format := range []string{"csv", "json"} {
+		b.Run(format, func(b *testing.B) {
+			withColumns(b, format)
+			s := benchSite()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.line = benchLine(s, format)
+			}
+		})
+	}
+}
+
+// TestDedupWatch checks that with -watch and -dedup-output a site whose
+// result changes back is output again while a duplicate in the same
+// pass is not
+func TestDedupWatch(t *testing.T) {
+	defer func(d bool, w time.Duration) { dedupOutput, watchInterval = d, w }(dedupOutput, watchInterval)
+	dedupOutput = true
+	watchInterval = time.Minute
+	withColumns(t, "csv")
+
+	var out bytes.Buffer
+	result := make(chan *site)
+	stop := make(chan struct{})
+	go writer(&out, result, stop, false)
+
+	watchPass.Add(6)
+	for pass, present := range []bool{true, false, true} {
+		for _, path := range []string{"/", "/index.html"} {
+			s := &site{host: "example.com", origin: "example.com", path: path,
+				resolves: tri{ran: true, yesno: true},
+				present:  tri{ran: true, yesno: present},
+				pass:     pass}
+			s.line = s.String()
+			result <- s
+		}
+	}
+	close(result)
+	<-stop
+
+	want := "example.com,example.com,t,t,-,-\n" +
+		"example.com,example.com,t,f,-,-\n" +
+		"example.com,example.com,t,t,-,-\n"
+	if out.String() != want {
+		t.Errorf("output %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// How often a followed -input-source=file is checked for new input
+// once everything in it has been read
+const followInterval = time.Second
+
+// openInput opens the input source named by -input-source: stdin,
+// file (the file at path, followed like tail -f) or pipe (the named
+// pipe at path, reopened each time a writer closes it). Sources other
+// than stdin never reach the end of their input so that a long running
+// headscan picks up new targets as they are added. All of them return
+// io.EOF once the run has been aborted or interrupted.
+func openInput(source, path string) (io.ReadCloser, error) {
+	switch source {
+	case "stdin":
+		return &abortableStdin{}, nil
+	case "file":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &followedFile{f}, nil
+	case "pipe":
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode()&os.ModeNamedPipe == 0 {
+			return nil, fmt.Errorf("%s is not a named pipe", path)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			<-aborted
+			f.Close()
+		}()
+		return &namedPipe{f}, nil
+	}
+	return nil, fmt.Errorf("unknown input source %q", source)
+}
+
+// abortableStdin is stdin, which is read in the background so that
+// waiting for input can be given up when the run is aborted
+type abortableStdin struct {
+	pending chan stdinRead
+}
+
+// stdinRead is the result of a read from stdin
+type stdinRead struct {
+	b   []byte
+	err error
+}
+
+func (s *abortableStdin) Read(p []byte) (int, error) {
+	if s.pending == nil {
+		s.pending = make(chan stdinRead, 1)
+		b := make([]byte, len(p))
+		go func() {
+			n, err := os.Stdin.Read(b)
+			s.pending <- stdinRead{b[:n], err}
+		}()
+	}
+
+	select {
+	case r := <-s.pending:
+		s.pending = nil
+		return copy(p, r.b), r.err
+	case <-aborted:
+		return 0, io.EOF
+	}
+}
+
+func (s *abortableStdin) Close() error {
+	return os.Stdin.Close()
+}
+
+// followedFile is a file that is read as it grows
+type followedFile struct {
+	*os.File
+}
+
+func (f *followedFile) Read(p []byte) (int, error) {
+	for {
+		n, err := f.File.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+
+		select {
+		case <-time.After(followInterval):
+		case <-aborted:
+			return 0, io.EOF
+		}
+	}
+}
+
+// namedPipe is a named pipe that several writers can send input to in
+// turn. It is opened for writing as well as reading so that opening it
+// does not wait for a writer and it never reaches the end of its input
+// when a writer closes it. It is closed when the run is aborted, which
+// ends a read that is waiting for input.
+type namedPipe struct {
+	*os.File
+}
+
+func (p *namedPipe) Read(b []byte) (int, error) {
+	n, err := p.File.Read(b)
+	if err != nil {
+		select {
+		case <-aborted:
+			return n, io.EOF
+		default:
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain runs headscan itself, with the arguments in HEADSCAN_ARGS,
+// when the test binary is started by runHeadscan
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("HEADSCAN_ARGS"); ok {
+		os.Args = append([]string{"headscan"}, strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runHeadscan starts headscan with args in a process of its own
+func runHeadscan(t *testing.T, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "HEADSCAN_ARGS="+strings.Join(args, " "))
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+// TestInterruptPipe checks that SIGINT stops a run reading from a named
+// pipe both while no writer has it open and while an idle one does
+func TestInterruptPipe(t *testing.T) {
+	for _, writer := range []bool{false, true} {
+		fifo := filepath.Join(t.TempDir(), "input")
+		if err := syscall.Mkfifo(fifo, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := runHeadscan(t, "-header=Server", "-input-source=pipe",
+			"-input-path="+fifo)
+		if writer {
+			w, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+		}
+		time.Sleep(500 * time.Millisecond)
+		cmd.Process.Signal(os.Interrupt)
+
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+		select {
+		case err := <-exited:
+			if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != 1 {
+				t.Errorf("writer %v: exited with %v, want status 1", writer, err)
+			}
+		case <-time.After(2 * time.Second):
+			cmd.Process.Kill()
+			t.Errorf("writer %v: still running 2s after SIGINT", writer)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// jsonLine returns the site as a JSON object with a member for each
+// output field, in the order of columns, for -format=json. As with
+// Parquet tri fields are booleans and int fields numbers, both being
+// null when the value is unknown, and every other field is a string.
+func (s *site) jsonLine() string {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, c := range columns {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(c.name)
+		b.Write(name)
+		b.WriteByte(':')
+
+		v := c.value(s)
+		switch c.kind {
+		case kindTri:
+			switch v {
+			case triStrings.yes:
+				b.WriteString("true")
+			case triStrings.no:
+				b.WriteString("false")
+			default:
+				b.WriteString("null")
+			}
+		case kindInt:
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				b.WriteString(strconv.FormatInt(n, 10))
+			} else {
+				b.WriteString("null")
+			}
+		default:
+			value, _ := json.Marshal(v)
+			b.Write(value)
+		}
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Size in bytes after which output files are rotated (set by
+// -output-rotate-size, 0 for no rotation)
+var rotateSize int64
+
+// outputList is the list of places results are written to. It
+// implements flag.Value so that -output can be repeated or given a
+// comma separated list.
+type outputList []string
+
+func (o *outputList) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *outputList) Set(value string) error {
+	*o = append(*o, strings.Split(value, ",")...)
+	return nil
+}
+
+// openOutput opens the named output for writing. The name - means
+// stdout and names ending .gz are written gzip compressed. Files are
+// rotated if rotateSize is set, with header (if not empty) written at
+// the start of each new file.
+func openOutput(name, header string) (io.WriteCloser, error) {
+	if name == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	w, err := openFile(name)
+	if err != nil || rotateSize == 0 {
+		return w, err
+	}
+	return &rotatingFile{name: name, header: header, w: w}, nil
+}
+
+// openFile creates the named file, compressing it if the name ends .gz
+func openFile(name string) (io.WriteCloser, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(name, ".gz") {
+		return &gzipFile{gzip.NewWriter(f), f}, nil
+	}
+
+	return f, nil
+}
+
+// rotatingFile is an output file that is closed once more than
+// rotateSize bytes (before any compression) have been written to it,
+// the output continuing in a new file named after it with .1, .2 and
+// so on added before any .gz. Files are only split at the end of a
+// line so that each contains whole results.
+type rotatingFile struct {
+	name   string // Name of the first file
+	header string // Written at the start of each new file
+	n      int    // Number of the current file (0 for the first)
+	size   int64  // Bytes written to the current file
+	full   bool   // Whether the next write goes in a new file
+	w      io.WriteCloser
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if r.full {
+			if err := r.rotate(); err != nil {
+				return written, err
+			}
+		}
+
+		// Write up to the end of the line that takes the file past
+		// rotateSize, or everything if there is no such line yet
+
+		chunk := p
+		if r.size+int64(len(p)) > rotateSize {
+			start := rotateSize - r.size - 1
+			if start < 0 {
+				start = 0
+			}
+			if i := bytes.IndexByte(p[start:], '\n'); i != -1 {
+				chunk = p[:start+int64(i)+1]
+			}
+		}
+
+		n, err := r.w.Write(chunk)
+		written += n
+		r.size += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+
+		r.full = r.size >= rotateSize && chunk[len(chunk)-1] == '\n'
+	}
+	return written, nil
+}
+
+// rotate closes the current file and starts the next one
+func (r *rotatingFile) rotate() error {
+	if err := r.w.Close(); err != nil {
+		return err
+	}
+
+	r.n++
+	name := fmt.Sprintf("%s.%d", r.name, r.n)
+	if strings.HasSuffix(r.name, ".gz") {
+		name = fmt.Sprintf("%s.%d.gz", strings.TrimSuffix(r.name, ".gz"), r.n)
+	}
+
+	w, err := openFile(name)
+	if err != nil {
+		return err
+	}
+	r.w = w
+	r.full = false
+
+	n, err := io.WriteString(w, r.header)
+	r.size = int64(n)
+	return err
+}
+
+func (r *rotatingFile) Close() error {
+	return r.w.Close()
+}
+
+// nopCloser is a writer whose Close does nothing. It is used for stdout
+// which must stay open.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// gzipFile is a file being written with gzip compression. Closing it
+// flushes the compressed stream and closes the file.
+type gzipFile struct {
+	*gzip.Writer
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Writer.Close()
+	if cerr := g.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// How often a lost -output-net connection is redialed and how much
+// output is kept for it while it is down. Once more than
+// netBacklogSize bytes are waiting the oldest lines are dropped. A
+// listener that does not accept a write within netWriteTimeout is
+// treated as lost so that it cannot hold up the writer.
+const (
+	netRetryInterval = time.Second
+	netBacklogSize   = 64 << 20
+	netWriteTimeout  = 5 * time.Second
+)
+
+// openNet connects to the -output-net address addr, which is
+// tcp://host:port or unix:///path, returning an output that streams to
+// it. The first connection must succeed; if it is lost later the
+// output is kept and sent once a new connection is made, starting with
+// header (if not empty) as the listener sees a new stream. Problems are
+// written to the log file l.
+func openNet(addr, header string, l *os.File) (io.WriteCloser, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &netOutput{addr: addr, header: header, l: l}
+	switch u.Scheme {
+	case "tcp":
+		n.network, n.address = "tcp", u.Host
+	case "unix":
+		n.network, n.address = "unix", u.Path
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if n.address == "" {
+		return nil, fmt.Errorf("no address in %s", addr)
+	}
+
+	if n.conn, err = net.Dial(n.network, n.address); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// netOutput is an output streamed to a network listener. Writes never
+// fail so that the other outputs are not affected when the listener
+// goes away: anything that cannot be sent is kept in backlog until the
+// connection has been redialed.
+type netOutput struct {
+	addr             string // As given to -output-net, for logging
+	network, address string
+	header           string
+	l                *os.File
+
+	conn    net.Conn  // nil while disconnected
+	backlog []byte    // Output waiting to be sent
+	dialed  time.Time // When the connection was last redialed
+	dropped int64     // Bytes lost because the backlog was full
+}
+
+func (n *netOutput) Write(p []byte) (int, error) {
+	n.backlog = append(n.backlog, p...)
+	if over := len(n.backlog) - netBacklogSize; over > 0 {
+
+		// Drop whole lines so that the listener never sees part of one
+
+		cut := over
+		if i := bytes.IndexByte(n.backlog[over:], '\n'); i != -1 {
+			cut += i + 1
+		} else {
+			cut = len(n.backlog)
+		}
+		n.dropped += int64(cut)
+		n.logf("Backlog full, dropped %d bytes", cut)
+		n.backlog = n.backlog[cut:]
+	}
+
+	n.send()
+	return len(p), nil
+}
+
+// send writes the backlog to the listener, redialing if the
+// connection has been lost and it is at least netRetryInterval since
+// the last attempt
+func (n *netOutput) send() {
+	if n.conn == nil {
+		if time.Since(n.dialed) < netRetryInterval {
+			return
+		}
+		n.dialed = time.Now()
+
+		conn, err := net.Dial(n.network, n.address)
+		if err != nil {
+			n.logf("Error reconnecting: %s", err)
+			return
+		}
+		n.logf("Reconnected")
+		n.conn = conn
+		n.backlog = append([]byte(n.header), n.backlog...)
+	}
+
+	n.conn.SetWriteDeadline(time.Now().Add(netWriteTimeout))
+	written, err := n.conn.Write(n.backlog)
+	n.backlog = n.backlog[written:]
+	if err != nil {
+		n.logf("Error writing, will reconnect: %s", err)
+		n.conn.Close()
+		n.conn = nil
+		n.dialed = time.Now()
+	}
+}
+
+// Close tries for a few seconds to send anything left in the backlog
+// before closing the connection
+func (n *netOutput) Close() error {
+	for try := 0; len(n.backlog) > 0 && try < 5; try++ {
+		if try > 0 {
+			time.Sleep(netRetryInterval)
+		}
+		n.send()
+	}
+
+	var err error
+	if n.conn != nil {
+		err = n.conn.Close()
+	}
+	if len(n.backlog) > 0 {
+		err = fmt.Errorf("%d bytes were not sent", len(n.backlog))
+	}
+	if err == nil && n.dropped > 0 {
+		err = fmt.Errorf("%d bytes were dropped", n.dropped)
+	}
+	return err
+}
+
+func (n *netOutput) logf(format string, a ...interface{}) {
+	if n.l != nil {
+		fmt.Fprintf(n.l, "%s: %s\n", n.addr, fmt.Sprintf(format, a...))
+	}
+}
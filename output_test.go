@@ -0,0 +1,165 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readOutput returns the contents of an output file, decompressing it
+// if its name ends .gz
+func readOutput(t *testing.T, name string) string {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		if r, err = gzip.NewReader(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotatingFile(t *testing.T) {
+	defer func(size int64) { rotateSize = size }(rotateSize)
+
+	tests := []struct {
+		name   string
+		size   int64
+		header string
+		writes []string
+		files  []string // Contents of the first file, the .1 file and so on
+	}{
+		{
+			name:   "line per write",
+			size:   10,
+			header: "h\n",
+			writes: []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n"},
+			files:  []string{"aaaa\nbbbb\n", "h\ncccc\ndddd\n", "h\neeee\n"},
+		},
+		{
+			name:   "several lines in a write",
+			size:   6,
+			writes: []string{"1\n22\n333\n4444\n55555\n666666\n"},
+			files:  []string{"1\n22\n333\n", "4444\n55555\n", "666666\n"},
+		},
+		{
+			name:   "line split across writes",
+			size:   5,
+			writes: []string{"abcdefghijkl", "\nnext\n"},
+			files:  []string{"abcdefghijkl\n", "next\n"},
+		},
+		{
+			name:   "exactly full",
+			size:   5,
+			writes: []string{"abcd\n", "efgh\n"},
+			files:  []string{"abcd\n", "efgh\n"},
+		},
+		{
+			name:   "under the limit",
+			size:   100,
+			header: "h\n",
+			writes: []string{"abcd\n", "efgh\n"},
+			files:  []string{"abcd\nefgh\n"},
+		},
+	}
+
+	for _, test := range tests {
+		for _, gz := range []string{"", ".gz"} {
+			rotateSize = test.size
+			dir := t.TempDir()
+			name := filepath.Join(dir, "out.csv"+gz)
+
+			w, err := openOutput(name, test.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range test.writes {
+				if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+					t.Fatalf("%s: Write(%q) = %d, %v", test.name, s, n, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			names := []string{name}
+			for i := 1; i < len(test.files); i++ {
+				names = append(names, fmt.Sprintf("%s.%d%s",
+					filepath.Join(dir, "out.csv"), i, gz))
+			}
+			for i, file := range test.files {
+				if got := readOutput(t, names[i]); got != file {
+					t.Errorf("%s: %s contains %q, want %q", test.name,
+						filepath.Base(names[i]), got, file)
+				}
+			}
+
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(test.files) {
+				t.Errorf("%s: %d files written for %s, want %d", test.name,
+					len(entries), filepath.Base(name), len(test.files))
+			}
+		}
+	}
+}
+
+// TestNetOutputStalled checks that a listener that stays connected but
+// stops reading is treated as lost rather than blocking the writer
+func TestNetOutputStalled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	w, err := openNet("tcp://"+ln.Addr().String(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := w.(*netOutput)
+
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	start := time.Now()
+	written := 0
+	for n.conn != nil {
+		if time.Since(start) > netWriteTimeout+5*time.Second {
+			t.Fatalf("writes still blocking after %s", time.Since(start))
+		}
+		if _, err := w.Write(line); err != nil {
+			t.Fatal(err)
+		}
+		written += len(line)
+	}
+
+	if len(n.backlog) == 0 || len(n.backlog) >= written {
+		t.Errorf("%d bytes in the backlog after writing %d", len(n.backlog), written)
+	}
+}
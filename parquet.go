@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetWriter writes sites as the rows of a Parquet file with one
+// column per output field. tri fields are stored as booleans and int
+// fields as 64-bit integers, both of which are null when the value is
+// unknown. Every other field is stored as a string.
+type parquetWriter struct {
+	w *parquet.Writer
+
+	// The schema's columns are sorted by name; order gives the index
+	// in columns of each of them
+	order []int
+}
+
+func newParquetWriter(out io.Writer) *parquetWriter {
+	group := parquet.Group{}
+	for _, c := range columns {
+		switch c.kind {
+		case kindTri:
+			group[c.name] = parquet.Optional(parquet.Leaf(parquet.BooleanType))
+		case kindInt:
+			group[c.name] = parquet.Optional(parquet.Int(64))
+		default:
+			group[c.name] = parquet.String()
+		}
+	}
+
+	p := &parquetWriter{}
+	for i := range columns {
+		p.order = append(p.order, i)
+	}
+	sort.SliceStable(p.order, func(i, j int) bool {
+		return columns[p.order[i]].name < columns[p.order[j]].name
+	})
+
+	p.w = parquet.NewWriter(out, parquet.NewSchema("headscan", group))
+	return p
+}
+
+// write adds s as a row
+func (p *parquetWriter) write(s *site) error {
+	row := make(parquet.Row, len(p.order))
+	for i, ci := range p.order {
+		c := columns[ci]
+		v := c.value(s)
+
+		null := parquet.NullValue().Level(0, 0, i)
+		switch c.kind {
+		case kindTri:
+			switch v {
+			case triStrings.yes:
+				row[i] = parquet.BooleanValue(true).Level(0, 1, i)
+			case triStrings.no:
+				row[i] = parquet.BooleanValue(false).Level(0, 1, i)
+			default:
+				row[i] = null
+			}
+		case kindInt:
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				row[i] = parquet.Int64Value(n).Level(0, 1, i)
+			} else {
+				row[i] = null
+			}
+		default:
+			row[i] = parquet.ByteArrayValue([]byte(v)).Level(0, 0, i)
+		}
+	}
+
+	_, err := p.w.WriteRows([]parquet.Row{row})
+	return err
+}
+
+// close writes any buffered rows and the file footer
+func (p *parquetWriter) close() error {
+	return p.w.Close()
+}
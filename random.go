@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// random is the source of all the random choices headscan makes, such
+// as -request-timeout-jitter, -ip-select=random, the -user-agent-file
+// entry for each request, the jitter in -retry-backoff=exponential and
+// the resolver server queried by exchange. It is seeded by -seed so
+// that a run can be repeated. It is shared by the workers so the
+// sequence each of them sees depends on scheduling unless -workers=1.
+var random *lockedRand
+
+// lockedRand is a *rand.Rand that is safe for concurrent use, which
+// one from rand.New is not
+type lockedRand struct {
+	sync.Mutex
+	r *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.Lock()
+	defer l.Unlock()
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Int63n(n int64) int64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.r.Int63n(n)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// If true the header names sent by each site are captured before
+// net/http canonicalizes them (set by -no-canonicalize-response)
+var rawHeaders bool
+
+// record wraps conn in a headerRecorder for the site being tested, if
+// there is one
+func record(ctx context.Context, conn net.Conn) net.Conn {
+	if s, ok := ctx.Value(siteKey{}).(*site); ok {
+		return &headerRecorder{Conn: conn, s: s}
+	}
+	return conn
+}
+
+// recordingDial returns a dialer whose connections record the response
+// headers read from them (see record)
+func recordingDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return record(ctx, conn), nil
+	}
+}
+
+// recordingTransport returns a transport for -no-canonicalize-response
+// whose connections record the response headers they read for the
+// site being tested. Keep-alives are disabled so that each response is
+// read from a connection of its own, and TLS connections are recorded
+// above TLS so that the plaintext is what is recorded.
+func recordingTransport(dial dialFunc) *http.Transport {
+	return &http.Transport{
+		DialContext:       recordingDial(dial),
+		DialTLSContext:    recordingDial(dialTLS(dial)),
+		TLSClientConfig:   tlsConfig.Clone(),
+		DisableKeepAlives: true,
+	}
+}
+
+// headerRecorder is a connection that keeps a copy of what is read
+// from it up to the end of the first response's headers and then gives
+// it to the site
+type headerRecorder struct {
+	net.Conn
+	s    *site
+	buf  bytes.Buffer
+	done bool
+}
+
+func (r *headerRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if !r.done && n > 0 {
+		r.buf.Write(p[:n])
+
+		// Lines may end with a bare \n, which net/http accepts
+
+		b := r.buf.Bytes()
+		end := bytes.Index(b, []byte("\r\n\r\n"))
+		if end == -1 {
+			end = bytes.Index(b, []byte("\n\n"))
+		}
+		if end != -1 {
+			r.done = true
+			r.s.rawMu.Lock()
+			r.s.raw = append([]byte(nil), b[:end]...)
+			r.s.rawMu.Unlock()
+		}
+	}
+	return n, err
+}
+
+// rawNames returns the distinct spellings of name among the header
+// names in the last response headers recorded for the site, in the
+// order they first appear, separated by ;
+func (s *site) rawNames(name string) string {
+	s.rawMu.Lock()
+	defer s.rawMu.Unlock()
+
+	var names []string
+	lines := strings.Split(string(s.raw), "\n")
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i == -1 {
+			continue
+		}
+
+		n := line[:i]
+		if !strings.EqualFold(n, name) {
+			continue
+		}
+
+		seen := false
+		for _, m := range names {
+			seen = seen || m == n
+		}
+		if !seen {
+			names = append(names, n)
+		}
+	}
+	return strings.Join(names, ";")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// If non-zero the limit on dialing, the TLS handshake, waiting for the
+// response headers and each request attempt as a whole (set by
+// -timeout)
+var requestTimeout time.Duration
+
+// resolveError is the error returned when a name cannot be resolved,
+// so that DNS failures can be told apart from other failures to
+// connect
+type resolveError struct {
+	name string
+	err  error
+}
+
+func (e *resolveError) Error() string {
+	return "resolving " + e.name + ": " + e.err.Error()
+}
+
+func (e *resolveError) Unwrap() error {
+	return e.err
+}
+
+// errorClass classifies why a request failed: dns, timeout, refused,
+// reset (the connection was closed or reset by the peer), unreachable,
+// tls, redirect-loop, cancelled (by the watchdog or because the run was
+// interrupted) or other
+func errorClass(err error) string {
+	var re *resolveError
+	var ne net.Error
+	var ve *tls.CertificateVerificationError
+	var he tls.RecordHeaderError
+	var ae tls.AlertError
+
+	switch {
+	case errors.Is(err, errTooManyRedirects):
+		return "redirect-loop"
+	case errors.As(err, &re):
+		return "dns"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.As(err, &ve), errors.As(err, &he), errors.As(err, &ae):
+		return "tls"
+	}
+	return "other"
+}
+
+// retryable returns whether a request that failed with err is worth
+// retrying because the failure may be transient: a timeout, a reset
+// connection, an unreachable network or a DNS failure other than the
+// name not existing. A refused connection, a TLS failure or a redirect
+// loop will fail the same way again.
+func retryable(err error) bool {
+	switch errorClass(err) {
+	case "timeout", "reset", "unreachable":
+		return true
+	case "dns":
+		var re *resolveError
+		var de *net.DNSError
+		errors.As(err, &re)
+		if errors.As(re.err, &de) && de.IsNotFound {
+			return false
+		}
+		return re.err.Error() != "NXDOMAIN"
+	}
+	return false
+}
+
+// errorClass returns the class of the error (see errorClass) that stopped
+// the site from being tested: dns if its name did not resolve, empty if
+// it responded and - if it was not tested
+func (s *site) errorClass() string {
+	switch {
+	case !s.resolves.ran:
+		return "-"
+	case !s.resolves.yesno:
+		return "dns"
+	case s.err == nil:
+		return ""
+	}
+	return errorClass(s.err)
+}